@@ -3,6 +3,7 @@ package code
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
 )
 
 // Instructions is byte sequence of instruction that consists of Opcode and Operands
@@ -11,31 +12,50 @@ type Instructions []byte
 type Opcode byte
 
 // Define Opcode
+// OpAdd, OpSub, OpMul, OpDivは整数同士なら整数（除算は0方向への切り捨て），
+// どちらかが小数なら両方を小数にして計算する
 const (
-	OpConstant         Opcode = iota // 0
-	OpAdd                            // 1
-	OpSub                            // 2
-	OpMul                            // 3
-	OpDiv                            // 4
-	OpDone                           // 5
-	OpEQ                             // 6
-	OpNEQ                            // 7
-	OpLess                           // 8
-	OpGreater                        // 9
-	OpLoadGlobal                     // 10
-	OpStoreGlobal                    // 11
-	OpJNT                            // 12
-	OpJMP                            // 13
-	OpCall                           // 14
-	OpReturnValue                    // 15
-	OpLoadLocal                      // 16
-	OpStoreLocal                     // 17
-	OpInstance                       // 18
-	OpLoadMethod                     // 19
-	OpCallMethod                     // 20
-	OpLoadInstanceVal                // 21
-	OpStoreInstanceVal               // 22
-	OpReturn                         // 23
+	OpConstant           Opcode = iota // 0
+	OpAdd                              // 1
+	OpSub                              // 2
+	OpMul                              // 3
+	OpDiv                              // 4
+	OpDone                             // 5
+	OpEQ                               // 6
+	OpNEQ                              // 7
+	OpLess                             // 8
+	OpGreater                          // 9
+	OpLoadGlobal                       // 10
+	OpStoreGlobal                      // 11
+	OpJNT                              // 12
+	OpJMP                              // 13
+	OpCall                             // 14
+	OpReturnValue                      // 15
+	OpLoadLocal                        // 16
+	OpStoreLocal                       // 17
+	OpInstance                         // 18
+	OpLoadMethod                       // 19
+	OpCallMethod                       // 20
+	OpLoadInstanceVal                  // 21
+	OpStoreInstanceVal                 // 22
+	OpReturn                           // 23
+	OpStoreLocalChecked                // 24
+	OpStoreGlobalChecked               // 25
+	OpMod                              // 26
+	OpAnd                              // 27
+	OpOr                               // 28
+	OpXor                              // 29
+	OpShl                              // 30
+	OpShr                              // 31
+	OpTuple                            // 32
+	OpUnpack                           // 33
+	OpCallSplat                        // 34
+	OpCallMethodSplat                  // 35
+	OpDup                              // 36
+	OpPop                              // 37
+	OpMatch                            // 38
+	OpJumpTable                        // 39
+	OpRaise                            // 40
 )
 
 // Definition consits of Name and OperandWidths property
@@ -69,6 +89,32 @@ var definitions = map[Opcode]*Definition{
 	OpCallMethod:       {"OpCallMethod", []int{1}},
 	OpLoadInstanceVal:  {"OpLoadInstanceVal", []int{1}},
 	OpStoreInstanceVal: {"OpStoreInstanceVal", []int{1, 1}},
+	// 変数のindex, 格納できる値の型
+	OpStoreLocalChecked:  {"OpStoreLocalChecked", []int{1, 1}},
+	OpStoreGlobalChecked: {"OpStoreGlobalChecked", []int{1, 1}},
+	// 以下は整数同士のみ（OpShrは算術シフト）
+	OpMod: {"OpMod", []int{}},
+	OpAnd: {"OpAnd", []int{}},
+	OpOr:  {"OpOr", []int{}},
+	OpXor: {"OpXor", []int{}},
+	OpShl: {"OpShl", []int{}},
+	OpShr: {"OpShr", []int{}},
+	// 要素数
+	OpTuple:  {"OpTuple", []int{1}},
+	OpUnpack: {"OpUnpack", []int{1}},
+	// 積んだ値の数，展開するタプルの位置
+	// 展開後の引数の数はOpCall, OpCallMethodと同様に扱い，可変長引数の関数では固定引数より後ろをタプルにまとめる
+	OpCallSplat:       {"OpCallSplat", []int{1, 1}},
+	OpCallMethodSplat: {"OpCallMethodSplat", []int{1, 1}},
+	OpDup:             {"OpDup", []int{}},
+	OpPop:             {"OpPop", []int{}},
+	// 値とパターンを取り出し，一致（範囲ならincludeと同じく含まれる）すればtrueを積む
+	OpMatch: {"OpMatch", []int{}},
+	// 飛び先表の定数のindex. 値を取り出し表にあればその位置へ，なければ既定の位置へ飛ぶ
+	OpJumpTable: {"OpJumpTable", []int{2}},
+	// 値を取り出して送出する. エラーでなければobj.ErrRaisedのエラーで包む.
+	// 送出されたエラーは例外表のhandlerへ，なければ呼び出し元の関数へ伝わる
+	OpRaise: {"OpRaise", []int{}},
 }
 
 // Lookup finds Definition of Opcode
@@ -108,3 +154,53 @@ func Make(op Opcode, operands ...int) []byte {
 	}
 	return instruction
 }
+
+// ReadOperands decodes the operands of an instruction and returns them with the number of bytes read
+func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(def.OperandWidths))
+	offset := 0
+	for i, width := range def.OperandWidths {
+		switch width {
+		case 1:
+			operands[i] = int(ins[offset])
+		case 2:
+			operands[i] = int(binary.BigEndian.Uint16(ins[offset:]))
+		}
+		offset += width
+	}
+	return operands, offset
+}
+
+// String disassembles the instructions, one per line with its position
+func (ins Instructions) String() string {
+	var b strings.Builder
+	i := 0
+	for i < len(ins) {
+		def, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(&b, "%04d %v\n", i, err)
+			i++
+			continue
+		}
+		if i+1+width(def) > len(ins) {
+			fmt.Fprintf(&b, "%04d %s (truncated)\n", i, def.Name)
+			break
+		}
+		operands, n := ReadOperands(def, ins[i+1:])
+		fmt.Fprintf(&b, "%04d %s", i, def.Name)
+		for _, o := range operands {
+			fmt.Fprintf(&b, " %d", o)
+		}
+		b.WriteString("\n")
+		i += 1 + n
+	}
+	return b.String()
+}
+
+func width(def *Definition) int {
+	w := 0
+	for _, o := range def.OperandWidths {
+		w += o
+	}
+	return w
+}
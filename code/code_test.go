@@ -27,3 +27,20 @@ func TestMake(t *testing.T) {
 		}
 	}
 }
+
+func TestInstructionsString(t *testing.T) {
+	instructions := Instructions{}
+	instructions = append(instructions, Make(OpConstant, 1)...)
+	instructions = append(instructions, Make(OpStoreGlobalChecked, 0, 5)...)
+	instructions = append(instructions, Make(OpJNT, 258)...)
+	instructions = append(instructions, Make(OpDone)...)
+
+	expected := `0000 OpConstant 1
+0003 OpStoreGlobalChecked 0 5
+0006 OpJNT 258
+0009 OpDone
+`
+	if instructions.String() != expected {
+		t.Errorf("wrong disassembly\n%s", instructions.String())
+	}
+}
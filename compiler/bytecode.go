@@ -0,0 +1,257 @@
+package compiler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/takeru56/tcompiler/code"
+	"github.com/takeru56/tcompiler/obj"
+)
+
+// Bytecode is a compiled program, independent of the compiler
+type Bytecode struct {
+	Classes   []obj.Class
+	Constants []obj.Object
+	// トップレベルの命令列と例外表
+	Instructions code.Instructions
+	Handlers     []obj.Handler
+	// トップレベルのデバッグ情報（なければnil）
+	Debug *obj.Debug
+}
+
+type BytecodeErr struct {
+	Err    error
+	Offset int
+	Msg    string
+}
+
+// custom error
+var (
+	ErrIR    = errors.New("Invalid IR error")
+	ErrMerge = errors.New("Merge error")
+)
+
+func (be *BytecodeErr) Error() string {
+	if be.Err == ErrIR {
+		return fmt.Sprintf("%d: %v: %s", be.Offset, be.Err, be.Msg)
+	}
+	return fmt.Sprintf("%v: %s", be.Err, be.Msg)
+}
+
+// Equal reports whether b and other encode to the same IR
+func (b *Bytecode) Equal(other *Bytecode) bool {
+	var x, y bytes.Buffer
+	b.Encode(&x)
+	other.Encode(&y)
+	return bytes.Equal(x.Bytes(), y.Bytes())
+}
+
+// NumGlobals returns the number of global variables the program uses
+func (b *Bytecode) NumGlobals() int {
+	n := 0
+	b.eachCode(func(ins code.Instructions) {
+		walk(ins, func(op code.Opcode, operands []int, _ int) {
+			switch op {
+			case code.OpLoadGlobal, code.OpStoreGlobal, code.OpStoreGlobalChecked:
+				if operands[0]+1 > n {
+					n = operands[0] + 1
+				}
+			}
+		})
+	})
+	return n
+}
+
+// maxId returns the largest function id in the program
+func (b *Bytecode) maxId() int {
+	id := 0
+	for _, pool := range b.pools() {
+		for _, constant := range pool {
+			if f, ok := constant.(*obj.Function); ok && f.Id > id {
+				id = f.Id
+			}
+		}
+	}
+	return id
+}
+
+func (b *Bytecode) pools() [][]obj.Object {
+	pools := [][]obj.Object{b.Constants}
+	for _, class := range b.Classes {
+		pools = append(pools, class.ConstantPool)
+	}
+	return pools
+}
+
+// eachCode calls fn with the instructions of every function and the top level
+func (b *Bytecode) eachCode(fn func(ins code.Instructions)) {
+	for _, pool := range b.pools() {
+		for _, constant := range pool {
+			if f, ok := constant.(*obj.Function); ok {
+				fn(f.Instructions)
+			}
+		}
+	}
+	fn(b.Instructions)
+}
+
+// Merge returns a program running b and then other.
+// otherの定数，グローバル変数，クラス，関数idと飛び先をbの後ろへずらす
+func (b *Bytecode) Merge(other *Bytecode) (*Bytecode, error) {
+	main := b.Instructions
+	if len(main) > 0 && code.Opcode(main[len(main)-1]) == code.OpDone {
+		main = main[:len(main)-1]
+	}
+	r := relocation{
+		constants: len(b.Constants),
+		globals:   b.NumGlobals(),
+		classes:   len(b.Classes),
+		ids:       b.maxId(),
+		code:      len(main),
+	}
+	if r.globals+other.NumGlobals() > 256 || len(b.Classes)+len(other.Classes) > 256 || r.ids+other.maxId() > 255 {
+		return nil, &BytecodeErr{ErrMerge, 0, "too many globals, classes or functions"}
+	}
+	if len(main)+len(other.Instructions) > 0xffff {
+		return nil, &BytecodeErr{ErrMerge, 0, "too many instructions"}
+	}
+
+	merged := &Bytecode{
+		Classes:      append([]obj.Class{}, b.Classes...),
+		Constants:    append([]obj.Object{}, b.Constants...),
+		Instructions: append(code.Instructions{}, main...),
+		Handlers:     append([]obj.Handler{}, b.Handlers...),
+	}
+	// トップレベルで飛び先表を使うものだけ位置をずらす
+	tables := map[int]bool{}
+	walk(other.Instructions, func(op code.Opcode, operands []int, _ int) {
+		if op == code.OpJumpTable {
+			tables[operands[0]] = true
+		}
+	})
+	for i, constant := range other.Constants {
+		merged.Constants = append(merged.Constants, r.constant(constant, true, tables[i+1]))
+	}
+	for _, class := range other.Classes {
+		class.Index += r.classes
+		pool := []obj.Object{}
+		for _, constant := range class.ConstantPool {
+			pool = append(pool, r.constant(constant, false, false))
+		}
+		class.ConstantPool = pool
+		merged.Classes = append(merged.Classes, class)
+	}
+	merged.Instructions = append(merged.Instructions, r.instructions(other.Instructions, true, true)...)
+	for _, h := range other.Handlers {
+		merged.Handlers = append(merged.Handlers, obj.Handler{Start: h.Start + r.code, End: h.End + r.code, Target: h.Target + r.code})
+	}
+	if b.Debug != nil && other.Debug != nil {
+		merged.Debug = r.debug(b.Debug, other.Debug)
+	}
+	return merged, nil
+}
+
+// debug joins the debug info of the top levels. どちらかになければ結合しない
+func (r relocation) debug(first *obj.Debug, second *obj.Debug) *obj.Debug {
+	d := &obj.Debug{Name: first.Name, Locals: append([]string{}, first.Locals...), Lines: []obj.Line{}}
+	for len(d.Locals) < r.globals {
+		d.Locals = append(d.Locals, "")
+	}
+	d.Locals = append(d.Locals, second.Locals...)
+	for _, l := range first.Lines {
+		if l.Offset < r.code {
+			d.Lines = append(d.Lines, l)
+		}
+	}
+	for _, l := range second.Lines {
+		d.Lines = append(d.Lines, obj.Line{Offset: l.Offset + r.code, Line: l.Line})
+	}
+	return d
+}
+
+// relocation is the amount to shift each kind of index of a merged program
+type relocation struct {
+	constants int
+	globals   int
+	classes   int
+	ids       int
+	code      int
+}
+
+// constant relocates a constant. topは定数がトップレベルの定数表にあるか，mainはトップレベルの飛び先表か
+func (r relocation) constant(constant obj.Object, top bool, main bool) obj.Object {
+	switch constant := constant.(type) {
+	case *obj.Function:
+		f := *constant
+		f.Id = r.id(f.Id)
+		if top && f.RetLimit > 0 {
+			f.RetLimit += r.constants
+		}
+		f.Instructions = r.instructions(f.Instructions, top, false)
+		return &f
+	case *obj.Constraint:
+		c := *constant
+		if c.Predicate >= 0 {
+			c.Predicate = r.id(c.Predicate)
+		}
+		return &c
+	case *obj.JumpTable:
+		if !main {
+			return constant
+		}
+		j := &obj.JumpTable{Min: constant.Min, Targets: []int{}, Default: constant.Default + r.code}
+		for _, t := range constant.Targets {
+			j.Targets = append(j.Targets, t+r.code)
+		}
+		return j
+	}
+	return constant
+}
+
+// initのid 0はどのプログラムでも同じ
+func (r relocation) id(id int) int {
+	if id == 0 {
+		return 0
+	}
+	return id + r.ids
+}
+
+func (r relocation) instructions(ins code.Instructions, top bool, main bool) code.Instructions {
+	out := append(code.Instructions{}, ins...)
+	walk(ins, func(op code.Opcode, operands []int, pos int) {
+		switch op {
+		case code.OpConstant, code.OpJumpTable:
+			if top {
+				operands[0] += r.constants
+			}
+		case code.OpLoadGlobal, code.OpStoreGlobal, code.OpStoreGlobalChecked:
+			operands[0] += r.globals
+		case code.OpInstance:
+			operands[0] += r.classes
+		case code.OpLoadMethod:
+			operands[0] = r.id(operands[0])
+		case code.OpJNT, code.OpJMP:
+			if main {
+				operands[0] += r.code
+			}
+		default:
+			return
+		}
+		copy(out[pos:], code.Make(op, operands...))
+	})
+	return out
+}
+
+// walk calls fn with each instruction of ins and its position
+func walk(ins code.Instructions, fn func(op code.Opcode, operands []int, pos int)) {
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return
+		}
+		operands, n := code.ReadOperands(def, ins[i+1:])
+		fn(code.Opcode(ins[i]), operands, i)
+		i += 1 + n
+	}
+}
@@ -1,15 +1,18 @@
 package compiler
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"math"
 
 	"github.com/takeru56/tcompiler/code"
 	"github.com/takeru56/tcompiler/obj"
 	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
 )
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) {
+	c.markLine()
 	ins := code.Make(op, operands...)
 	for _, i := range ins {
 		c.scopes[c.scopeIndex].instructions = append(c.scopes[c.scopeIndex].instructions, i)
@@ -25,18 +28,54 @@ type Compiler struct {
 	classPool      []obj.Class
 	FlagClassScope bool
 	mTable         *MethodTable
+	sTable         *SignatureTable
+	// 最初に見つけたエラー
+	err error
+}
+
+type CompileErr struct {
+	Err error
+	L   token.Loc
+	Msg string
+}
+
+// custom error
+var (
+	ErrUndefined = errors.New("Undefined error")
+	ErrArity     = errors.New("Arity error")
+	ErrCall      = errors.New("Call error")
+)
+
+func (ce *CompileErr) Error() string {
+	if ce.L.File == nil && ce.L.Line == 0 {
+		return fmt.Sprintf("%v: %s", ce.Err, ce.Msg)
+	}
+	return fmt.Sprintf("%v: %v: %s\n%v", ce.L, ce.Err, ce.Msg, ce.L.Show())
 }
 
 func newCompiler(program []parser.Node) *Compiler {
 	main := CompilationScope{table: NewSymbolTable()}
-	c := &Compiler{program, []obj.Object{}, []CompilationScope{main}, 0, NewClassTable(), []obj.Class{}, false, NewMethodTable()}
+	c := &Compiler{p: program, constantPool: []obj.Object{}, scopes: []CompilationScope{main}, cTable: NewClassTable(), classPool: []obj.Class{}, mTable: NewMethodTable(), sTable: NewSignatureTable(program)}
 	return c
 }
 
+// errorf records the error at n unless one has been found. 残りのノードも生成は続けるが結果は捨てる
+func (c *Compiler) errorf(n parser.Node, err error, format string, a ...interface{}) {
+	if c.err == nil {
+		c.err = &CompileErr{err, n.Pos(), fmt.Sprintf(format, a...)}
+	}
+}
+
 type CompilationScope struct {
 	instructions code.Instructions
 	numLocal     int
 	table        *SymbolTable
+	handlers     []obj.Handler
+	// returnの前に実行するensure節（外側から順に）
+	ensures [][]parser.Node
+	// 生成中のノードの行番号と，行番号表
+	line  int
+	lines []obj.Line
 }
 
 func (c *Compiler) enterClass() {
@@ -55,28 +94,82 @@ func (c *Compiler) currentClass() *obj.Class {
 func (c *Compiler) enterScope() {
 	t := NewSymbolTable()
 	t.outerScope = c.currentScope().table
+	line := c.currentScope().line
 	c.scopeIndex++
-	c.scopes = append(c.scopes, CompilationScope{numLocal: 0, table: t})
+	c.scopes = append(c.scopes, CompilationScope{numLocal: 0, table: t, line: line})
 }
 
-func (c *Compiler) leaveScope() code.Instructions {
-	instructions := c.scopes[c.scopeIndex].instructions
+func (c *Compiler) leaveScope() CompilationScope {
+	scope := c.scopes[c.scopeIndex]
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
-	return instructions
+	return scope
+}
+
+// markLine starts a new entry of the line table if the line has changed since the last instruction
+func (c *Compiler) markLine() {
+	scope := c.currentScope()
+	if scope.line == 0 {
+		return
+	}
+	n := len(scope.lines)
+	if n > 0 && scope.lines[n-1].Line == scope.line {
+		return
+	}
+	if n > 0 && scope.lines[n-1].Offset == len(scope.instructions) {
+		scope.lines[n-1].Line = scope.line
+		return
+	}
+	scope.lines = append(scope.lines, obj.Line{Offset: len(scope.instructions), Line: scope.line})
+}
+
+// debug builds the debug information of a scope
+func debug(name string, scope CompilationScope) *obj.Debug {
+	locals := make([]string, scope.table.symbolCount)
+	for n, symbol := range scope.table.store {
+		locals[symbol.Index] = n
+	}
+	return &obj.Debug{Name: name, Locals: locals, Lines: scope.lines}
 }
 
 func (c *Compiler) currentScope() *CompilationScope {
 	return &c.scopes[c.scopeIndex]
 }
 
-func Exec(program []parser.Node) *Compiler {
-	c := newCompiler(program)
+// Exec compiles the program, or returns the first error found in it
+func Exec(program []parser.Node) (*Bytecode, error) {
+	return New().Compile(program)
+}
+
+// New returns a Compiler keeping the names defined by the programs it compiles
+func New() *Compiler {
+	return newCompiler([]parser.Node{})
+}
+
+// Compile compiles program as the continuation of the programs compiled before.
+// 返すBytecodeは今までの定数とクラスを全て持ち，トップレベルの命令列はprogramの分だけ（REPL用）
+func (c *Compiler) Compile(program []parser.Node) (*Bytecode, error) {
+	c.p = append(c.p, program...)
+	c.sTable.Add(program)
+	c.err = nil
+	main := c.currentScope()
+	main.instructions = code.Instructions{}
+	main.handlers = nil
+	main.lines = nil
 	for _, node := range program {
 		c.gen(node)
 	}
 	c.emit(code.OpDone, []int{}...)
-	return c
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.bytecode(), nil
+}
+
+// bytecode takes the compiled program out of the compiler
+func (c *Compiler) bytecode() *Bytecode {
+	main := c.scopes[c.scopeIndex]
+	return &Bytecode{Classes: c.classPool, Constants: c.constantPool, Instructions: main.instructions, Handlers: main.handlers, Debug: debug("main", main)}
 }
 
 func (c *Compiler) addConstant(obj obj.Object) int {
@@ -89,10 +182,19 @@ func (c *Compiler) addConstant(obj obj.Object) int {
 }
 
 func (c *Compiler) gen(n parser.Node) {
+	// 子のノードの後に出す命令は元の行に戻す
+	if l := n.Pos().Line; l > 0 {
+		outer := c.currentScope().line
+		c.currentScope().line = l
+		defer func() { c.currentScope().line = outer }()
+	}
+
 	switch node := n.(type) {
 	case parser.IntegerLiteral:
 		integer := &obj.Integer{Value: node.Val}
 		c.emit(code.OpConstant, []int{c.addConstant(integer)}...)
+	case parser.FloatLiteral:
+		c.emit(code.OpConstant, []int{c.addConstant(&obj.Float{Value: node.Val})}...)
 	case parser.BoolLiteral:
 		if node.Tok.Literal == "true" {
 			c.emit(code.OpConstant, []int{c.addConstant(&obj.Bool{Value: 1})}...)
@@ -121,6 +223,18 @@ func (c *Compiler) gen(n parser.Node) {
 			c.emit(code.OpLess, []int{}...)
 		case parser.Greater:
 			c.emit(code.OpGreater, []int{}...)
+		case parser.Mod:
+			c.emit(code.OpMod, []int{}...)
+		case parser.BitAnd:
+			c.emit(code.OpAnd, []int{}...)
+		case parser.BitOr:
+			c.emit(code.OpOr, []int{}...)
+		case parser.BitXor:
+			c.emit(code.OpXor, []int{}...)
+		case parser.Shl:
+			c.emit(code.OpShl, []int{}...)
+		case parser.Shr:
+			c.emit(code.OpShr, []int{}...)
 		}
 	case parser.IdentExpr:
 		if c.scopeIndex > 0 && c.FlagClassScope && node.FSelf {
@@ -147,42 +261,34 @@ func (c *Compiler) gen(n parser.Node) {
 			return
 		}
 
-		// ひとまず握りつぶしとく
-		fmt.Println("Undefined identifier")
-		os.Exit(1)
+		c.errorf(node, ErrUndefined, "undefined variable %s", node.Name)
 
 	case parser.AssignStmt:
 		c.gen(node.Expr)
-		// instance variable
-		if c.scopeIndex > 0 && c.FlagClassScope && node.Ident.FSelf {
-			class, _ := c.cTable.Resolve(c.currentClass().Name)
-			id := class.DefineInstanceVal(node.Ident.Name)
-			c.currentClass().NumInstanceVal = class.instanceValCount
-			if node.Ident.ValType == parser.Include || node.Ident.ValType == parser.Exclude {
-				c.gen(node.Ident.ValLimit)
-			}
-			c.emit(code.OpStoreInstanceVal, []int{id, parser.ValTypeToInt(node.Ident.ValType)}...)
-			return
-		}
-		// local variable
-		if c.scopeIndex > 0 {
-			symbol, ok := c.currentScope().table.Resolve(node.Ident.Name)
-			if ok {
-				c.emit(code.OpStoreLocal, []int{symbol.Index}...)
+		c.assign(node.Ident)
+	case parser.MultiAssignStmt:
+		tuple, ok := node.Expr.(parser.TupleExpr)
+		if ok {
+			if len(tuple.Elems) != len(node.Idents) {
+				c.errorf(node, ErrArity, "cannot assign %d values to %d variables", len(tuple.Elems), len(node.Idents))
 				return
 			}
-			local := c.currentScope().table.DefineLocal(node.Ident.Name)
-			c.emit(code.OpStoreLocal, []int{local.Index}...)
-			return
+			// タプルを作らずに値を並べて積む
+			for _, elem := range tuple.Elems {
+				c.gen(elem)
+			}
+		} else {
+			c.gen(node.Expr)
+			c.emit(code.OpUnpack, []int{len(node.Idents)}...)
 		}
-		// global variable
-		symbol, ok := c.currentScope().table.Resolve(node.Ident.Name)
-		if ok {
-			c.emit(code.OpStoreGlobal, []int{symbol.Index}...)
-			return
+		for i := len(node.Idents) - 1; i >= 0; i-- {
+			c.assign(node.Idents[i])
 		}
-		global := c.currentScope().table.DefineGlobal(node.Ident.Name)
-		c.emit(code.OpStoreGlobal, []int{global.Index}...)
+	case parser.TupleExpr:
+		for _, elem := range node.Elems {
+			c.gen(elem)
+		}
+		c.emit(code.OpTuple, []int{len(node.Elems)}...)
 	case parser.IfStmt:
 		c.gen(node.Condition)
 		c.emit(code.OpJNT, []int{0}...)
@@ -195,6 +301,14 @@ func (c *Compiler) gen(n parser.Node) {
 
 		c.scopes[c.scopeIndex].instructions[ifHead+1] = ins[1]
 		c.scopes[c.scopeIndex].instructions[ifHead+2] = ins[2]
+	case parser.CaseStmt:
+		c.gen(node.Subject)
+		min, arms, ok := denseArms(node)
+		if ok {
+			c.genJumpTable(node, min, arms)
+			return
+		}
+		c.genJumpChain(node)
 	case parser.WhileStmt:
 		head := len(c.scopes[c.scopeIndex].instructions)
 		c.gen(node.Condition)
@@ -218,15 +332,15 @@ func (c *Compiler) gen(n parser.Node) {
 				cc.hasInit = true
 			}
 			c.enterScope()
-			for _, arg := range node.Args {
-				c.currentScope().table.DefineLocal(arg.Name)
-			}
+			c.defineArgs(node.Args)
 			for _, stmt := range node.Block.Nodes {
 				c.gen(stmt)
 			}
 			c.emit(code.OpReturn, []int{}...)
-			instructions := c.leaveScope()
-			objFunc := &obj.Function{Id: id, Instructions: instructions, NumArg: len(node.Args)}
+			scope := c.leaveScope()
+			objFunc := c.newFunction(id, scope.instructions, node)
+			objFunc.Handlers = scope.handlers
+			objFunc.Debug = debug(class.Name+"."+node.Ident.Name, scope)
 			class.ConstantPool = append(c.classPool[len(c.classPool)-1].ConstantPool, objFunc)
 			return
 		}
@@ -236,15 +350,15 @@ func (c *Compiler) gen(n parser.Node) {
 		}
 
 		c.enterScope()
-		for _, arg := range node.Args {
-			c.currentScope().table.DefineLocal(arg.Name)
-		}
+		c.defineArgs(node.Args)
 		for _, stmt := range node.Block.Nodes {
 			c.gen(stmt)
 		}
 		c.emit(code.OpReturn, []int{}...)
-		instructions := c.leaveScope()
-		objFunc := &obj.Function{Id: id, Instructions: instructions, NumArg: len(node.Args)}
+		scope := c.leaveScope()
+		objFunc := c.newFunction(id, scope.instructions, node)
+		objFunc.Handlers = scope.handlers
+		objFunc.Debug = debug(node.Ident.Name, scope)
 		c.emit(code.OpConstant, []int{c.addConstant(objFunc)}...)
 
 		if ok {
@@ -254,13 +368,26 @@ func (c *Compiler) gen(n parser.Node) {
 		c.emit(code.OpStoreGlobal, []int{symbol.Index}...)
 	case parser.CallExpr:
 		c.gen(node.Ident)
-		for _, expr := range node.Args {
-			c.gen(expr)
-		}
-		c.emit(code.OpCall, []int{len(node.Args)}...)
+		sig, ok := c.sTable.ResolveFunc(node.Ident.Name)
+		n, splat := c.genArgs(node, node.Ident.Name, node.Args, sig, ok)
+		c.emitCall(code.OpCall, code.OpCallSplat, n, splat)
 	case parser.ReturnStmt:
 		c.gen(node.Expr)
+		// 内側のensure節から順に実行する
+		ensures := c.currentScope().ensures
+		for i := len(ensures) - 1; i >= 0; i-- {
+			c.currentScope().ensures = ensures[:i]
+			c.genBlock(ensures[i])
+		}
+		c.currentScope().ensures = ensures
 		c.emit(code.OpReturnValue, []int{}...)
+	case parser.RaiseStmt:
+		c.gen(node.Expr)
+		c.emit(code.OpRaise, []int{}...)
+	case parser.BeginStmt:
+		c.genBegin(node)
+	case parser.ImportStmt:
+		// importはmodule.Linkerがリンク時に取り除く
 	case parser.ClassDef:
 		ct := c.cTable.DefineClass(node.Ident.Name)
 		c.classPool = append(c.classPool, obj.Class{Name: node.Ident.Name, Index: ct.Index, NumInstanceVal: 0, NumMethod: 0, ConstantPool: []obj.Object{}})
@@ -276,23 +403,435 @@ func (c *Compiler) gen(n parser.Node) {
 		// call init\
 		if class.hasInit {
 			c.emit(code.OpLoadMethod, []int{0}...)
-			for _, expr := range node.Args {
-				c.gen(expr)
-			}
-			c.emit(code.OpCallMethod, []int{len(node.Args)}...)
+			sig, ok := c.sTable.ResolveInit(node.Ident.Name)
+			n, splat := c.genArgs(node, node.Ident.Name, node.Args, sig, ok)
+			c.emitCall(code.OpCallMethod, code.OpCallMethodSplat, n, splat)
 		}
 	case parser.CallMethodExpr:
 		c.gen(node.Receiver)
 		call, ok := node.Method.(parser.CallExpr)
 		if !ok {
-			fmt.Println("method error")
-			os.Exit(1)
+			c.errorf(node, ErrCall, "cannot call %T as a method", node.Method)
+			return
 		}
 		id, _ := c.mTable.ResolveMethodId(call.Ident.Name)
 		c.emit(code.OpLoadMethod, []int{id}...)
-		for _, expr := range call.Args {
-			c.gen(expr)
+		sig, ok := c.sTable.ResolveMethod(call.Ident.Name)
+		n, splat := c.genArgs(call, call.Ident.Name, call.Args, sig, ok)
+		c.emitCall(code.OpCallMethod, code.OpCallMethodSplat, n, splat)
+	}
+}
+
+// maxJumpTableSize is the largest span of values compiled to a jump table
+const maxJumpTableSize = 256
+
+// denseArms returns the smallest value and the index of the when clause for each value from it,
+// if all patterns are integers dense enough to use a jump table. 該当する節がない値は-1
+func denseArms(node parser.CaseStmt) (int, []int, bool) {
+	if len(node.Whens) < 3 {
+		return 0, nil, false
+	}
+	entries := map[int]int{}
+	min, max := math.MaxInt32, math.MinInt32
+	add := func(v, arm int) {
+		// 先に書かれた節を優先する
+		if _, ok := entries[v]; !ok {
+			entries[v] = arm
+		}
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	for i, when := range node.Whens {
+		for _, pattern := range when.Patterns {
+			switch pattern := pattern.(type) {
+			case parser.IntegerLiteral:
+				add(pattern.Val, i)
+			case parser.IntegerRangeLiteral:
+				if pattern.To.Val-pattern.From.Val >= maxJumpTableSize {
+					return 0, nil, false
+				}
+				for v := pattern.From.Val; v <= pattern.To.Val; v++ {
+					add(v, i)
+				}
+			default:
+				return 0, nil, false
+			}
+		}
+	}
+	span := max - min + 1
+	if len(entries) == 0 || span > maxJumpTableSize || len(entries)*2 < span {
+		return 0, nil, false
+	}
+	arms := make([]int, span)
+	for i := range arms {
+		arms[i] = -1
+	}
+	for v, arm := range entries {
+		arms[v-min] = arm
+	}
+	return min, arms, true
+}
+
+func (c *Compiler) genJumpTable(node parser.CaseStmt, min int, arms []int) {
+	table := &obj.JumpTable{Min: min, Targets: make([]int, len(arms))}
+	c.emit(code.OpJumpTable, []int{c.addConstant(table)}...)
+	starts := []int{}
+	ends := []int{}
+	for _, when := range node.Whens {
+		starts = append(starts, c.pos())
+		for _, stmt := range when.Block.Nodes {
+			c.gen(stmt)
+		}
+		ends = append(ends, c.pos())
+		c.emit(code.OpJMP, []int{0}...)
+	}
+	table.Default = c.pos()
+	if node.Else != nil {
+		for _, stmt := range node.Else.Nodes {
+			c.gen(stmt)
+		}
+	}
+	for _, end := range ends {
+		c.patchJump(end, c.pos())
+	}
+	for i, arm := range arms {
+		if arm < 0 {
+			table.Targets[i] = table.Default
+			continue
+		}
+		table.Targets[i] = starts[arm]
+	}
+}
+
+// genJumpChain tests the subject on the stack top against each pattern in order.
+// 一致した節の先頭で対象を取り除く
+func (c *Compiler) genJumpChain(node parser.CaseStmt) {
+	ends := []int{}
+	for _, when := range node.Whens {
+		matched := []int{}
+		next := 0
+		for i, pattern := range when.Patterns {
+			c.emit(code.OpDup, []int{}...)
+			c.gen(pattern)
+			c.emit(code.OpMatch, []int{}...)
+			jnt := c.pos()
+			c.emit(code.OpJNT, []int{0}...)
+			if i == len(when.Patterns)-1 {
+				next = jnt
+				break
+			}
+			matched = append(matched, c.pos())
+			c.emit(code.OpJMP, []int{0}...)
+			c.patchJump(jnt, c.pos())
+		}
+		for _, m := range matched {
+			c.patchJump(m, c.pos())
+		}
+		c.emit(code.OpPop, []int{}...)
+		for _, stmt := range when.Block.Nodes {
+			c.gen(stmt)
+		}
+		ends = append(ends, c.pos())
+		c.emit(code.OpJMP, []int{0}...)
+		c.patchJump(next, c.pos())
+	}
+	c.emit(code.OpPop, []int{}...)
+	if node.Else != nil {
+		for _, stmt := range node.Else.Nodes {
+			c.gen(stmt)
+		}
+	}
+	for _, end := range ends {
+		c.patchJump(end, c.pos())
+	}
+}
+
+// genBegin emits the body, the rescue and the ensure of node and their exception table entries.
+// ensure節は通常の経路とエラーの経路それぞれに展開する
+func (c *Compiler) genBegin(node parser.BeginStmt) {
+	var ensure []parser.Node
+	if node.Ensure != nil {
+		ensure = node.Ensure.Nodes
+	}
+	ends := []int{}
+	start := c.pos()
+	c.withEnsure(ensure, node.Block.Nodes)
+	end := c.pos()
+	c.genBlock(ensure)
+	ends = append(ends, c.pos())
+	c.emit(code.OpJMP, []int{0}...)
+
+	if node.Rescue != nil {
+		handler := c.pos()
+		c.addHandler(start, end, handler)
+		if node.Ident != nil {
+			c.assign(*node.Ident)
+		} else {
+			c.emit(code.OpPop, []int{}...)
+		}
+		c.withEnsure(ensure, node.Rescue.Nodes)
+		rescueEnd := c.pos()
+		c.genBlock(ensure)
+		ends = append(ends, c.pos())
+		c.emit(code.OpJMP, []int{0}...)
+		// rescue節で送出されたエラーもensure節を通す
+		start, end = handler, rescueEnd
+	}
+	if node.Ensure != nil {
+		c.addHandler(start, end, c.pos())
+		c.genBlock(ensure)
+		c.emit(code.OpRaise, []int{}...)
+	}
+	for _, e := range ends {
+		c.patchJump(e, c.pos())
+	}
+}
+
+// withEnsure emits nodes so that a return among them runs ensure first
+func (c *Compiler) withEnsure(ensure []parser.Node, nodes []parser.Node) {
+	if ensure != nil {
+		c.currentScope().ensures = append(c.currentScope().ensures, ensure)
+	}
+	c.genBlock(nodes)
+	if ensure != nil {
+		ensures := c.currentScope().ensures
+		c.currentScope().ensures = ensures[:len(ensures)-1]
+	}
+}
+
+func (c *Compiler) addHandler(start, end, target int) {
+	if start == end {
+		return
+	}
+	c.currentScope().handlers = append(c.currentScope().handlers, obj.Handler{Start: start, End: end, Target: target})
+}
+
+func (c *Compiler) genBlock(nodes []parser.Node) {
+	for _, stmt := range nodes {
+		c.gen(stmt)
+	}
+}
+
+// pos returns the position of the next instruction in the current scope
+func (c *Compiler) pos() int {
+	return len(c.scopes[c.scopeIndex].instructions)
+}
+
+// patchJump rewrites the operand of the jump instruction at pos to target
+func (c *Compiler) patchJump(pos int, target int) {
+	ins := code.Make(code.OpJMP, []int{target}...)
+	c.scopes[c.scopeIndex].instructions[pos+1] = ins[1]
+	c.scopes[c.scopeIndex].instructions[pos+2] = ins[2]
+}
+
+// assign stores the value on the stack top into ident
+func (c *Compiler) assign(ident parser.IdentExpr) {
+	// instance variable
+	if c.scopeIndex > 0 && c.FlagClassScope && ident.FSelf {
+		class, _ := c.cTable.Resolve(c.currentClass().Name)
+		id, ok := class.ResolveInstanceVal(ident.Name)
+		if !ok {
+			id = class.DefineInstanceVal(ident.Name)
+		}
+		c.currentClass().NumInstanceVal = class.instanceValCount
+		c.genLimit(ident.ValType, ident.ValLimit, ident.Constraint)
+		c.emit(code.OpStoreInstanceVal, []int{id, parser.ValTypeToInt(ident.ValType)}...)
+		return
+	}
+	// local variable
+	if c.scopeIndex > 0 {
+		symbol, ok := c.currentScope().table.Resolve(ident.Name)
+		if !ok {
+			symbol = c.currentScope().table.DefineLocal(ident.Name)
+		}
+		if ident.ValType != parser.Any {
+			symbol = c.currentScope().table.Constrain(ident)
+		}
+		c.store(symbol)
+		return
+	}
+	// global variable
+	symbol, ok := c.currentScope().table.Resolve(ident.Name)
+	if !ok {
+		symbol = c.currentScope().table.DefineGlobal(ident.Name)
+	}
+	if ident.ValType != parser.Any {
+		symbol = c.currentScope().table.Constrain(ident)
+	}
+	c.store(symbol)
+}
+
+// genArgs pushes the arguments in the order of the parameters of sig, filling omitted ones with their defaults.
+// It returns the number of values pushed and the position of the splatted tuple, or -1 if there is none.
+// キーワード引数は引数の定義順に評価される
+func (c *Compiler) genArgs(at parser.Node, name string, args []parser.Node, sig parser.FunctionDef, ok bool) (int, int) {
+	splat := -1
+	for i, arg := range args {
+		if _, s := arg.(parser.SplatExpr); s {
+			if splat >= 0 {
+				c.errorf(arg, ErrCall, "only one splat argument is allowed for %s", name)
+				return 0, -1
+			}
+			splat = i
+		}
+	}
+	// 展開後の引数の数は実行時まで分からないので，既定値を補えない
+	if splat >= 0 && ok && sig.Required() < len(sig.Params()) {
+		c.errorf(args[splat], ErrCall, "cannot splat arguments for %s with default values", name)
+		return 0, -1
+	}
+	// 展開後の引数の数は実行時まで分からないのでそのまま積む
+	if splat >= 0 || !ok {
+		for _, arg := range args {
+			switch arg := arg.(type) {
+			case parser.KeywordArg:
+				c.errorf(arg, ErrCall, "cannot resolve keyword arguments for %s", name)
+				return 0, -1
+			case parser.SplatExpr:
+				c.gen(arg.Expr)
+			default:
+				c.gen(arg)
+			}
+		}
+		return len(args), splat
+	}
+
+	params := sig.Params()
+	ordered := make([]parser.Node, len(params))
+	surplus := []parser.Node{}
+	for i, arg := range args {
+		kw, isKw := arg.(parser.KeywordArg)
+		if !isKw {
+			if i < len(params) {
+				ordered[i] = arg
+				continue
+			}
+			if !sig.Variadic {
+				c.errorf(at, ErrArity, "%s takes %d arguments but %d given", name, len(params), len(args))
+				return 0, -1
+			}
+			surplus = append(surplus, arg)
+			continue
+		}
+		idx := -1
+		for j, param := range params {
+			if param.Name == kw.Name {
+				idx = j
+			}
+		}
+		if idx < 0 {
+			c.errorf(kw, ErrUndefined, "unknown keyword %s for %s", kw.Name, name)
+			return 0, -1
+		}
+		if ordered[idx] != nil {
+			c.errorf(kw, ErrArity, "argument %s given twice for %s", kw.Name, name)
+			return 0, -1
+		}
+		ordered[idx] = kw.Expr
+	}
+	for i, arg := range ordered {
+		if arg == nil {
+			if i >= len(sig.Defaults) || sig.Defaults[i] == nil {
+				c.errorf(at, ErrArity, "missing argument %s for %s", params[i].Name, name)
+				return 0, -1
+			}
+			arg = sig.Defaults[i]
+		}
+		c.gen(arg)
+	}
+	// 残りの引数はVMがタプルにまとめる
+	for _, arg := range surplus {
+		c.gen(arg)
+	}
+	return len(ordered) + len(surplus), -1
+}
+
+// emitCall emits op for a call with n arguments, or splatOp if the argument at position splat is spread
+func (c *Compiler) emitCall(op, splatOp code.Opcode, n int, splat int) {
+	if splat >= 0 {
+		c.emit(splatOp, []int{n, splat}...)
+		return
+	}
+	c.emit(op, []int{n}...)
+}
+
+// store emits the store instruction for the symbol.
+// 制約付きの変数は値を検査してから格納する
+func (c *Compiler) store(symbol Symbol) {
+	if symbol.ValType == parser.Any {
+		if symbol.Scope == LocalScope {
+			c.emit(code.OpStoreLocal, []int{symbol.Index}...)
+			return
+		}
+		c.emit(code.OpStoreGlobal, []int{symbol.Index}...)
+		return
+	}
+	c.genLimit(symbol.ValType, symbol.ValLimit, symbol.Constraint)
+	if symbol.Scope == LocalScope {
+		c.emit(code.OpStoreLocalChecked, []int{symbol.Index, parser.ValTypeToInt(symbol.ValType)}...)
+		return
+	}
+	c.emit(code.OpStoreGlobalChecked, []int{symbol.Index, parser.ValTypeToInt(symbol.ValType)}...)
+}
+
+// genLimit pushes the constant a checked store compares the value with
+func (c *Compiler) genLimit(vt parser.IdentValType, lim parser.IntegerRangeLiteral, cons parser.ValConstraint) {
+	limit := c.limitConstant(vt, lim, cons)
+	if limit != nil {
+		c.emit(code.OpConstant, []int{c.addConstant(limit)}...)
+	}
+}
+
+// limitConstant returns the range or constraint constant for the value type, or nil if it needs none
+func (c *Compiler) limitConstant(vt parser.IdentValType, lim parser.IntegerRangeLiteral, cons parser.ValConstraint) obj.Object {
+	switch vt {
+	case parser.Include, parser.Exclude:
+		return &obj.Range{From: lim.From.Val, To: lim.To.Val}
+	case parser.Constrained:
+		constraint := &obj.Constraint{Predicate: -1}
+		for _, r := range cons.Include {
+			constraint.Include = append(constraint.Include, obj.Range{From: r.From.Val, To: r.To.Val})
+		}
+		for _, r := range cons.Exclude {
+			constraint.Exclude = append(constraint.Exclude, obj.Range{From: r.From.Val, To: r.To.Val})
+		}
+		for _, v := range cons.In {
+			constraint.In = append(constraint.In, v.Val)
+		}
+		if cons.Predicate != "" {
+			// 述語は定義前でも参照できるようにidを先に割り当てる
+			constraint.Predicate = c.mTable.DefineMethodId(cons.Predicate)
+		}
+		return constraint
+	}
+	return nil
+}
+
+// newFunction builds the function constant, describing its declared result type for the VM
+func (c *Compiler) newFunction(id int, instructions code.Instructions, node parser.FunctionDef) *obj.Function {
+	objFunc := &obj.Function{Id: id, Instructions: instructions, NumArg: len(node.Args), Variadic: node.Variadic, RetType: parser.ValTypeToInt(node.Result.ValType)}
+	limit := c.limitConstant(node.Result.ValType, node.Result.ValLimit, node.Result.Constraint)
+	if limit != nil {
+		objFunc.RetLimit = c.addConstant(limit)
+	}
+	return objFunc
+}
+
+// defineArgs defines the arguments as locals and checks the constrained ones on entry
+func (c *Compiler) defineArgs(args []parser.IdentExpr) {
+	for _, arg := range args {
+		c.currentScope().table.DefineLocal(arg.Name)
+	}
+	for _, arg := range args {
+		if arg.ValType == parser.Any {
+			continue
 		}
-		c.emit(code.OpCallMethod, []int{len(call.Args)}...)
+		symbol := c.currentScope().table.Constrain(arg)
+		c.emit(code.OpLoadLocal, []int{symbol.Index}...)
+		c.store(symbol)
 	}
 }
@@ -1,10 +1,18 @@
 package compiler
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"log"
 	"os/exec"
+	"strings"
 	"testing"
+
+	"github.com/takeru56/tcompiler/obj"
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
 )
 
 // output tarto IR bytecode Format
@@ -31,32 +39,54 @@ func TestCompile(t *testing.T) {
 		source   string
 		bytecode []byte
 	}{
-		{"23", []byte{0, 1, 0, 0, 2, 0, 23, 0, 4, 0, 0, 1, 5}},
-		{"256+1", []byte{0, 2, 0, 0, 2, 1, 0, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 1, 5}},
-		{"1-1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 2, 5}},
-		{"1*1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 3, 5}},
-		{"1/1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 4, 5}},
-		{"1>1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 9, 5}},
-		{"a = 1", []byte{0, 1, 0, 0, 2, 0, 1, 0, 6, 0, 0, 1, 11, 0, 5}},
-		{"a = 2 a == 2", []byte{0, 2, 0, 0, 2, 0, 2, 0, 0, 2, 0, 2, 0, 12, 0, 0, 1, 11, 0, 10, 0, 0, 0, 2, 6, 5}},
-		{"a = 1 b = 2 b", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 13, 0, 0, 1, 11, 0, 0, 0, 2, 11, 1, 10, 1, 5}},
-		{"if 1 > 1 do 1+1 end a = 1", []byte{0, 5, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 23, 0, 0, 1, 0, 0, 2, 9, 12, 0, 17, 0, 0, 3, 0, 0, 4, 1, 0, 0, 5, 11, 0, 5}},
-		{"while 1 > 0 do 1 end 1", []byte{0, 4, 0, 0, 2, 0, 1, 0, 0, 2, 0, 0, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 20, 0, 0, 1, 0, 0, 2, 9, 12, 0, 16, 0, 0, 3, 13, 0, 0, 0, 0, 4, 5}},
-		{"a = 1 while 5 > a do a=a+1 end a", []byte{0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 5, 0, 0, 2, 0, 1, 0, 28, 0, 0, 1, 11, 0, 0, 0, 2, 10, 0, 9, 12, 0, 25, 10, 0, 0, 0, 3, 1, 11, 0, 13, 0, 5, 10, 0, 5}},
-		{"def myFunc() 2+3 end", []byte{0, 3, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 1, 1, 0, 8, 0, 0, 1, 0, 0, 2, 1, 23, 0, 6, 0, 0, 3, 11, 0, 5}},
-		{"def myFunc() return 2+3 end myFunc()", []byte{0, 3, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 1, 1, 0, 9, 0, 0, 1, 0, 0, 2, 1, 15, 23, 0, 10, 0, 0, 3, 11, 0, 10, 0, 14, 0, 5}},
+		{"23", []byte{0, 1, 0, 0, 2, 0, 23, 0, 4, 0, 0, 1, 5, 0}},
+		{"256+1", []byte{0, 2, 0, 0, 2, 1, 0, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 1, 5, 0}},
+		{"1-1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 2, 5, 0}},
+		{"1*1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 3, 5, 0}},
+		{"1/1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 4, 5, 0}},
+		{"1>1", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 8, 0, 0, 1, 0, 0, 2, 9, 5, 0}},
+		{"a = 1", []byte{0, 1, 0, 0, 2, 0, 1, 0, 6, 0, 0, 1, 11, 0, 5, 0}},
+		{"a = 2 a == 2", []byte{0, 2, 0, 0, 2, 0, 2, 0, 0, 2, 0, 2, 0, 12, 0, 0, 1, 11, 0, 10, 0, 0, 0, 2, 6, 5, 0}},
+		{"a = 1 b = 2 b", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 13, 0, 0, 1, 11, 0, 0, 0, 2, 11, 1, 10, 1, 5, 0}},
+		{"if 1 > 1 do 1+1 end a = 1", []byte{0, 5, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 23, 0, 0, 1, 0, 0, 2, 9, 12, 0, 17, 0, 0, 3, 0, 0, 4, 1, 0, 0, 5, 11, 0, 5, 0}},
+		{"while 1 > 0 do 1 end 1", []byte{0, 4, 0, 0, 2, 0, 1, 0, 0, 2, 0, 0, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 20, 0, 0, 1, 0, 0, 2, 9, 12, 0, 16, 0, 0, 3, 13, 0, 0, 0, 0, 4, 5, 0}},
+		{"a = 1 while 5 > a do a=a+1 end a", []byte{0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 5, 0, 0, 2, 0, 1, 0, 28, 0, 0, 1, 11, 0, 0, 0, 2, 10, 0, 9, 12, 0, 25, 10, 0, 0, 0, 3, 1, 11, 0, 13, 0, 5, 10, 0, 5, 0}},
+		{"def myFunc() 2+3 end", []byte{0, 3, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 1, 1, 0, 0, 4, 0, 0, 0, 8, 0, 0, 1, 0, 0, 2, 1, 23, 0, 0, 6, 0, 0, 3, 11, 0, 5, 0}},
+		{"def myFunc() return 2+3 end myFunc()", []byte{0, 3, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 1, 1, 0, 0, 4, 0, 0, 0, 9, 0, 0, 1, 0, 0, 2, 1, 15, 23, 0, 0, 10, 0, 0, 3, 11, 0, 10, 0, 14, 0, 5, 0}},
+		{"def myFunc(a: number) return a end", []byte{0, 1, 1, 1, 1, 0, 4, 0, 0, 0, 9, 16, 0, 24, 0, 0, 16, 0, 15, 23, 0, 0, 6, 0, 0, 1, 11, 0, 5, 0}},
+		{"a: number = 1 a = 2", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 13, 0, 0, 1, 25, 0, 0, 0, 0, 2, 25, 0, 0, 5, 0}},
+		{"a: {include: 1..3, 5..6, in: [9], check: ok} = 1", []byte{0, 2, 0, 0, 2, 0, 1, 4, 0, 25, 2, 0, 0, 0, 1, 0, 0, 0, 3, 0, 0, 0, 5, 0, 0, 0, 6, 0, 1, 0, 0, 0, 9, 1, 1, 0, 10, 0, 0, 1, 0, 0, 2, 25, 0, 7, 5, 0}},
+		{"a = -5 b = 100000 c = -3..70000", []byte{0, 3, 0, 0, 2, 255, 251, 0, 0, 4, 0, 1, 134, 160, 3, 0, 8, 255, 255, 255, 253, 0, 1, 17, 112, 0, 16, 0, 0, 1, 11, 0, 0, 0, 2, 11, 1, 0, 0, 3, 11, 2, 5, 0}},
+		{"3.14 * -2", []byte{0, 2, 5, 0, 4, 64, 72, 245, 195, 0, 0, 2, 255, 254, 0, 8, 0, 0, 1, 0, 0, 2, 3, 5, 0}},
+		{"7 % 4 & 3 | 1 << 2", []byte{0, 5, 0, 0, 2, 0, 7, 0, 0, 2, 0, 4, 0, 0, 2, 0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 20, 0, 0, 1, 0, 0, 2, 26, 0, 0, 3, 27, 0, 0, 4, 0, 0, 5, 30, 28, 5, 0}},
+		{"a = 1 b = 2 a, b = b, a", []byte{0, 2, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 19, 0, 0, 1, 11, 0, 0, 0, 2, 11, 1, 10, 1, 10, 0, 11, 1, 11, 0, 5, 0}},
+		{"def f() return 1, 2 end a, b = f()", []byte{0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 1, 1, 0, 0, 4, 0, 0, 0, 10, 0, 0, 1, 0, 0, 2, 32, 2, 15, 23, 0, 0, 16, 0, 0, 3, 11, 0, 10, 0, 14, 0, 33, 2, 11, 1, 11, 2, 5, 0}},
+		{"def f(a, b = 2) return a end f(b: 3, a: 1) f(1)", []byte{0, 5, 1, 1, 2, 0, 4, 0, 0, 0, 4, 16, 0, 15, 23, 0, 0, 0, 2, 0, 1, 0, 0, 2, 0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 26, 0, 0, 1, 11, 0, 10, 0, 0, 0, 2, 0, 0, 3, 14, 2, 10, 0, 0, 0, 4, 0, 0, 5, 14, 2, 5, 0}},
+		{"def sum(a, *xs) return a end sum(1, 2, 3) t = 1, 2 sum(0, *t)", []byte{0, 7, 1, 1, 2, 1, 4, 0, 0, 0, 4, 16, 0, 15, 23, 0, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 0, 2, 0, 0, 0, 39, 0, 0, 1, 11, 0, 10, 0, 0, 0, 2, 0, 0, 3, 0, 0, 4, 14, 3, 0, 0, 5, 0, 0, 6, 32, 2, 11, 1, 10, 0, 0, 0, 7, 10, 1, 34, 2, 1, 5, 0}},
+		{"x = 3 case x when 1 then a = 1 when 2..5 then a = 2 else a = 3 end", []byte{0, 6, 0, 0, 2, 0, 3, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 3, 0, 4, 0, 2, 0, 5, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 0, 48, 0, 0, 1, 11, 0, 10, 0, 36, 0, 0, 2, 38, 12, 0, 24, 37, 0, 0, 3, 11, 1, 13, 0, 47, 36, 0, 0, 4, 38, 12, 0, 41, 37, 0, 0, 5, 11, 1, 13, 0, 47, 37, 0, 0, 6, 11, 1, 5, 0}},
+		{"x = 3 case x when 1 then a = 1 when 2, 3 then a = 2 when 4..5 then a = 3 else a = 0 end", []byte{0, 6, 0, 0, 2, 0, 3, 6, 0, 18, 0, 0, 0, 1, 0, 5, 0, 10, 0, 18, 0, 18, 0, 26, 0, 26, 0, 34, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 0, 0, 2, 0, 0, 0, 40, 0, 0, 1, 11, 0, 10, 0, 39, 0, 2, 0, 0, 3, 11, 1, 13, 0, 39, 0, 0, 4, 11, 1, 13, 0, 39, 0, 0, 5, 11, 1, 13, 0, 39, 0, 0, 6, 11, 1, 5, 0}},
+		{"begin a = 1 raise 2 rescue e b = e ensure c = 3 end", []byte{0, 5, 0, 0, 2, 0, 1, 0, 0, 2, 0, 2, 0, 0, 2, 0, 3, 0, 0, 2, 0, 3, 0, 0, 2, 0, 3, 0, 38, 0, 0, 1, 11, 0, 0, 0, 2, 40, 0, 0, 3, 11, 1, 13, 0, 37, 11, 2, 10, 2, 11, 3, 0, 0, 4, 11, 1, 13, 0, 37, 0, 0, 5, 11, 1, 40, 5, 2, 0, 0, 0, 9, 0, 17, 0, 17, 0, 23, 0, 31}},
+		{"def f(x) begin return x / 0 ensure y = 1 end end", []byte{0, 5, 0, 0, 2, 0, 0, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 0, 0, 2, 0, 1, 1, 1, 1, 0, 4, 0, 0, 0, 27, 16, 0, 0, 0, 1, 4, 0, 0, 2, 17, 1, 15, 0, 0, 3, 17, 1, 13, 0, 26, 0, 0, 4, 17, 1, 40, 23, 1, 0, 0, 0, 12, 0, 20, 0, 6, 0, 0, 5, 11, 0, 5, 0}},
+		{"def area(w: number, h: number): {include: 0..99} return w*h end", []byte{0, 2, 3, 0, 4, 0, 0, 0, 99, 1, 1, 2, 0, 5, 0, 1, 0, 17, 16, 0, 24, 0, 0, 16, 1, 24, 1, 0, 16, 0, 16, 1, 3, 15, 23, 0, 0, 6, 0, 0, 2, 11, 0, 5, 0}},
 	}
 
+	// 16bitに収まらない整数を含むもの
+	wide := map[string]bool{"a = -5 b = 100000 c = -3..70000": true}
+
 	for _, c := range cases {
-		out, err := exec.Command("go", "run", "../", c.source).Output()
+		out, err := exec.Command("go", "run", "../", "-e", c.source).Output()
 		if err != nil {
 			log.Fatal(err)
 		}
-		s := "ffffffff"
-		s += "00" // class pool count
+		s := "00" // class pool count
 		for _, b := range c.bytecode {
 			s += fmt.Sprintf("%02x", b)
 		}
+		if wide[c.source] {
+			s = withHeader(s, FlagInt32)
+		} else {
+			s = withHeader(s, 0)
+		}
 
 		if string(out) != s {
 			fmt.Println("expected: " + s)
@@ -65,24 +95,30 @@ func TestCompile(t *testing.T) {
 		}
 	}
 
+	// 各セクションのバイト列
+	type sections struct {
+		constanPoolCount [2]byte
+		constantPool     []byte
+		instructionCount [2]byte
+		instractions     []byte
+	}
 	cases2 := []struct {
 		source   string
-		bytecode Bytecode
+		bytecode sections
 	}{
-		// {"23", Bytecode{[2]byte{0, 1}, []byte{0, 0, 2, 0, 23}, [2]byte{0, 4}, []byte{0, 0, 1, 5}}},
-		{"def myFunc() a = 1 return a end b = 3 b+myFunc()", Bytecode{[2]byte{0, 3}, []byte{0, 0, 2, 0, 1, 1, 1, 0, 9, 0, 0, 1, 17, 0, 16, 0, 15, 23, 0, 0, 2, 0, 3}, [2]byte{0, 18}, []byte{0, 0, 2, 11, 0, 0, 0, 3, 11, 1, 10, 1, 10, 0, 14, 0, 1, 5}}},
+		// {"23", sections{[2]byte{0, 1}, []byte{0, 0, 2, 0, 23}, [2]byte{0, 4}, []byte{0, 0, 1, 5}}},
+		{"def myFunc() a = 1 return a end b = 3 b+myFunc()", sections{[2]byte{0, 3}, []byte{0, 0, 2, 0, 1, 1, 1, 0, 0, 4, 0, 0, 0, 9, 0, 0, 1, 17, 0, 16, 0, 15, 23, 0, 0, 0, 2, 0, 3}, [2]byte{0, 18}, []byte{0, 0, 2, 11, 0, 0, 0, 3, 11, 1, 10, 1, 10, 0, 14, 0, 1, 5}}},
 		// 		{`23
 		// class LED
-		// end`, Bytecode{[2]byte{0, 1}, []byte{0, 0, 2, 0, 23}, [2]byte{0, 4}, []byte{0, 0, 1, 5}}},
+		// end`, sections{[2]byte{0, 1}, []byte{0, 0, 2, 0, 23}, [2]byte{0, 4}, []byte{0, 0, 1, 5}}},
 	}
 
 	for _, c := range cases2 {
-		out, err := exec.Command("go", "run", "../", c.source).Output()
+		out, err := exec.Command("go", "run", "../", "-e", c.source).Output()
 		if err != nil {
 			log.Fatal(err)
 		}
-		s := "ffffffff"
-		s += "00" // class pool count
+		s := "00" // class pool count
 		for _, b := range c.bytecode.constanPoolCount {
 			s += fmt.Sprintf("%02x", b)
 		}
@@ -95,6 +131,8 @@ func TestCompile(t *testing.T) {
 		for _, b := range c.bytecode.instractions {
 			s += fmt.Sprintf("%02x", b)
 		}
+		s += "00" // exception table count
+		s = withHeader(s, 0)
 
 		if string(out) != s {
 			fmt.Println("expected: " + s)
@@ -103,3 +141,182 @@ func TestCompile(t *testing.T) {
 		}
 	}
 }
+
+// withHeader prepends the header to the hex IR body
+func withHeader(body string, flags uint16) string {
+	b, _ := hex.DecodeString(body)
+	return fmt.Sprintf("%x%04x%04x%08x", Magic, Version, flags, crc32.ChecksumIEEE(b)) + body
+}
+
+var irSources = []string{
+	"23",
+	"a = 70000 b = 1.5 c = a * 2",
+	"def f(x) return x + 1 end f(3)",
+	"class A def init() self.v = 1 end end",
+	"case 2 when 1 then a = 1 when 2 then a = 2 when 3 then a = 3 end",
+	"begin raise 1 rescue e a = e ensure b = 1 end",
+	"a: {include: 1..3, 5..6, in: [9]} = 1 c = -3..70000",
+}
+
+func compile(t *testing.T, src string) *Bytecode {
+	p, err := parser.New(token.New(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := p.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Exec(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestExecErr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"a = 1\nb = c + 1", "2:5: Undefined error: undefined variable c"},
+		{"a, b = 1, 2, 3", "1:1: Arity error: cannot assign 3 values to 2 variables"},
+		{"def f(a) return a end\nf(1, 2)", "2:1: Arity error: f takes 1 arguments but 2 given"},
+		{"def f(a) return a end\nf(a: 1, b: 2)", "2:9: Undefined error: unknown keyword b for f"},
+		{"def f(a) return a end\ng = f\ng(a: 1)", "3:3: Call error: cannot resolve keyword arguments for g"},
+		{"def f(a, b = 2) return a + b end\nt = 1, 2\nf(*t)", "3:3: Call error: cannot splat arguments for f with default values"},
+		{"def f(a, *xs) return a end\nt = 1, 2\nf(*t, a: 1)", "3:7: Call error: cannot resolve keyword arguments for f"},
+	}
+
+	for _, c := range cases {
+		p, err := parser.New(token.New(c.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program, err := p.Program()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Exec(program)
+		if err == nil {
+			t.Errorf("%q: expected an error", c.input)
+			continue
+		}
+		if actual := strings.SplitN(err.Error(), "\n", 2)[0]; actual != c.expected {
+			t.Errorf("%q: expected %s, got %s", c.input, c.expected, actual)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, src := range irSources {
+		c := compile(t, src)
+		var b bytes.Buffer
+		if err := c.Encode(&b); err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(b.Bytes()) != c.Hex() {
+			t.Errorf("%s: binary and hex IR differ\n%x\n%s", src, b.Bytes(), c.Hex())
+		}
+		if b.Len()*2 != len(c.Hex()) {
+			t.Errorf("%s: binary IR must be half the size of hex", src)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, src := range irSources {
+		c := compile(t, src)
+		var b bytes.Buffer
+		if err := c.Encode(&b); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Decode(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if !decoded.Equal(c) {
+			t.Errorf("%s: decoded IR differs\n%s\n%s", src, decoded.Hex(), c.Hex())
+		}
+	}
+
+	c := compile(t, "a = 1 a + 2")
+	c.StripDebug()
+	var b bytes.Buffer
+	c.Encode(&b)
+	ir := b.Bytes()
+	corrupt := func(pos int, v byte) []byte {
+		broken := append([]byte{}, ir...)
+		broken[pos] = v
+		return broken
+	}
+	broken := []struct {
+		ir       []byte
+		expected string
+	}{
+		{[]byte{255, 255, 255, 255, 0}, "0: Invalid IR error: not a tarto IR file"},
+		{ir[:10], "10: Invalid IR error: unexpected end of IR"},
+		{corrupt(5, 9), "4: Invalid IR error: unsupported IR version 9, expected 1"},
+		{corrupt(6, 0x80), "6: Invalid IR error: unsupported flags 8000"},
+		{corrupt(7, 1), "6: Invalid IR error: flags 0001 do not match the program"},
+		{corrupt(len(ir)-2, 9), "8: Invalid IR error: checksum mismatch, the IR is corrupted"},
+		{append(append([]byte{}, ir...), 0), "8: Invalid IR error: checksum mismatch, the IR is corrupted"},
+	}
+	for _, c := range broken {
+		_, err := Decode(bytes.NewReader(c.ir))
+		if err == nil || err.Error() != c.expected {
+			t.Errorf("%x: expected %q but got %v", c.ir, c.expected, err)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := compile(t, "def f(x) return x + 1 end n = f(1)")
+	b := compile(t, "def g(x) return x * 2 end m = g(3) m")
+	merged, err := a.Merge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Equal(a) || merged.Equal(b) {
+		t.Error("merged IR must differ from its parts")
+	}
+	if merged.NumGlobals() != a.NumGlobals()+b.NumGlobals() {
+		t.Errorf("wrong number of globals %d", merged.NumGlobals())
+	}
+	again, _ := a.Merge(b)
+	if !merged.Equal(again) {
+		t.Error("merging must be deterministic")
+	}
+	if fmt.Sprint(merged.Debug.Locals) != "[f n g m]" {
+		t.Errorf("wrong global names %v", merged.Debug.Locals)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	src := `def add(a, b)
+  c = a + b
+  return c
+end
+
+x = 1
+y = add(x,
+  2)`
+	c := compile(t, src)
+
+	if c.Debug.Name != "main" || fmt.Sprint(c.Debug.Locals) != "[add x y]" {
+		t.Errorf("wrong main debug info %s %v", c.Debug.Name, c.Debug.Locals)
+	}
+	// 関数の定義，x = 1，y = add(x, 2)（引数の2は8行目）
+	if fmt.Sprint(c.Debug.Lines) != "[{0 1} {5 6} {10 7} {14 8} {17 7}]" {
+		t.Errorf("wrong line table of main %v", c.Debug.Lines)
+	}
+	f := c.Constants[0].(*obj.Function)
+	if f.Debug.Name != "add" || fmt.Sprint(f.Debug.Locals) != "[a b c]" {
+		t.Errorf("wrong function debug info %s %v", f.Debug.Name, f.Debug.Locals)
+	}
+	// 暗黙のOpReturnはdefの行になる
+	if f.Debug.LineAt(4) != 2 || f.Debug.LineAt(9) != 3 || f.Debug.LineAt(10) != 1 {
+		t.Errorf("wrong line table of add %v", f.Debug.Lines)
+	}
+}
@@ -0,0 +1,53 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/takeru56/tcompiler/code"
+	"github.com/takeru56/tcompiler/obj"
+)
+
+// Disasm returns a listing of the class pool, the constant pool and the instructions
+func (bc *Bytecode) Disasm() string {
+	var b strings.Builder
+	for i, class := range bc.Classes {
+		fmt.Fprintf(&b, "class %d %s (%d instance vals)\n", i, class.Name, class.NumInstanceVal)
+		writePool(&b, class.ConstantPool, "  ")
+	}
+	writePool(&b, bc.Constants, "")
+	b.WriteString("main:\n")
+	writeCode(&b, bc.Instructions, bc.Handlers, "  ")
+	return b.String()
+}
+
+// 定数のindexは1から始まる
+func writePool(b *strings.Builder, pool []obj.Object, indent string) {
+	for i, constant := range pool {
+		fn, ok := constant.(*obj.Function)
+		if !ok {
+			fmt.Fprintf(b, "%sconst %d: %s %s\n", indent, i+1, strings.ToLower(string(constant.Type())), constant.Inspect())
+			continue
+		}
+		fmt.Fprintf(b, "%sconst %d: function id %d, %d args", indent, i+1, fn.Id, fn.NumArg)
+		if fn.Variadic {
+			b.WriteString(", variadic")
+		}
+		if fn.RetLimit > 0 {
+			fmt.Fprintf(b, ", result const %d", fn.RetLimit)
+		}
+		b.WriteString("\n")
+		writeCode(b, fn.Instructions, fn.Handlers, indent+"  ")
+	}
+}
+
+func writeCode(b *strings.Builder, ins code.Instructions, handlers []obj.Handler, indent string) {
+	for _, line := range strings.SplitAfter(ins.String(), "\n") {
+		if line != "" {
+			b.WriteString(indent + line)
+		}
+	}
+	for _, h := range handlers {
+		fmt.Fprintf(b, "%shandler %04d-%04d -> %04d\n", indent, h.Start, h.End, h.Target)
+	}
+}
@@ -1,8 +1,14 @@
 package compiler
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
 
 	"github.com/takeru56/tcompiler/obj"
 )
@@ -11,13 +17,18 @@ import (
 // ***************************************
 
 // struct {
-// 	u4 magic
+// 	u4 magic ("TART")
+// 	u2 version
+// 	u2 flags (bit0: 32bit integers, bit1: debug info)
+// 	u4 checksum (CRC-32 of the rest)
 //	u1 class_pool_count
 //	c  class_pool[class_pool_count]
 // 	u2 constant_pool_count
 // 	constant_pool[constant_pool_count]
 // 	u2 instruction_count
 // 	byte[instruction_count]
+// 	exception_table
+// 	debug_info (flagsのbit1が立つときだけ)
 // }
 
 // struct class pool {
@@ -31,65 +42,235 @@ import (
 // 	u2 constant size
 // 	byte[constant size]
 // }
+
+// struct function {
+// 	u1 function id
+// 	u1 arg count
+// 	u1 flags (bit0: variadic)
+// 	u1 result type
+// 	u2 result limit constant index
+// 	u2 instruction_count
+// 	byte[instruction_count]
+// 	exception_table
+// }
+
+// struct exception_table {
+// 	u1 handler_count
+// 	u2 start, u2 end, u2 target [handler_count]
+// }
+
+// struct debug_info {
+// 	debug main (localsはグローバル変数)
+// 	debug functions[] (IR中の関数の定数と同じ順)
+// }
+
+// struct debug {
+// 	u1 name_length
+// 	byte[name_length] name
+// 	u1 local_count
+// 	(u1 name_length, byte[name_length] name)[local_count]
+// 	u2 line_count
+// 	(u2 offset, u2 line)[line_count]
+// }
+
+// integer: s2 or s4 (constant sizeで幅を判別)
+// range: from, to (それぞれconstant sizeの半分の幅)
+// float: IEEE 754 binary32
+// jump table: s4 min, u2 count, u2 targets[count], u2 default
+
+// struct constraint {
+// 	u1 include_count
+// 	s4 from, s4 to [include_count]
+// 	u1 exclude_count
+// 	s4 from, s4 to [exclude_count]
+// 	u1 in_count
+// 	s4 value [in_count]
+// 	u1 has_predicate
+// 	u1 predicate function id
+// }
 // ***************************************
 type ConstantType byte
 
 // Define Constant type
 const (
-	ConstInt   ConstantType = iota
-	ConstFunc  ConstantType = iota
-	ConstBool  ConstantType = iota
-	ConstRange ConstantType = iota
+	ConstInt        ConstantType = iota
+	ConstFunc       ConstantType = iota
+	ConstBool       ConstantType = iota
+	ConstRange      ConstantType = iota
+	ConstConstraint ConstantType = iota
+	ConstFloat      ConstantType = iota
+	ConstJumpTable  ConstantType = iota
 )
 
-// TODO: 32bitに拡張+エラー処理
-// TODO: Bytecodeの構造体を定義してCompilerから切り離す
-type Bytecode struct {
-	constanPoolCount [2]byte
-	constantPool     []byte
-	instructionCount [2]byte
-	instractions     []byte
+// Bytecode returns the IR as hex text
+func (b *Bytecode) Hex() string {
+	var buf bytes.Buffer
+	b.Encode(&buf)
+	return hex.EncodeToString(buf.Bytes())
 }
 
-func (c *Compiler) Bytecode() string {
-	b := ""
-	// u4 magic（特に意味無し）
-	b += fmt.Sprintf("%02x", []byte{255, 255, 255, 255})
-
+// Encode writes the IR to w as raw bytes
+func (b *Bytecode) Encode(w io.Writer) error {
+	// チェックサムのため本体を先に書き出す
+	var body bytes.Buffer
+	e := &encoder{w: &body}
 	// u1 class pool count
-	b += fmt.Sprintf("%02x", len(c.classPool))
+	e.u1(len(b.Classes))
 	// class pool[class pool count]
-	for _, class := range c.classPool {
+	for _, class := range b.Classes {
 		// u1 instance val count
-		b += fmt.Sprintf("%02x", class.NumInstanceVal)
+		e.u1(class.NumInstanceVal)
 		// u2 constant poool count
-		b += fmt.Sprintf("%02x", toUint16(len(class.ConstantPool)))
+		e.u2(len(class.ConstantPool))
 		// constant pool
-		b += writeConstant(class.ConstantPool)
+		e.constants(class.ConstantPool)
 	}
 	// u2 constant_pool_count
-	b += fmt.Sprintf("%02x", toUint16(len(c.constantPool)))
+	e.u2(len(b.Constants))
 	// const pool
-	b += writeConstant(c.constantPool)
+	e.constants(b.Constants)
 	// u2 instruction_count
-	b += fmt.Sprintf("%02x", toUint16(len(c.scopes[c.scopeIndex].instructions)))
+	e.u2(len(b.Instructions))
 
 	// instruction
-	for _, bytecode := range c.scopes[c.scopeIndex].instructions {
-		b += fmt.Sprintf("%02x", bytecode)
+	e.write(b.Instructions)
+	// exception table
+	e.handlers(b.Handlers)
+	// debug info
+	if b.Debug != nil {
+		e.debug(b.Debug)
+		for _, f := range b.functions() {
+			e.debug(f.Debug)
+		}
 	}
-	return b
+
+	h := &encoder{w: w}
+	// u4 magic
+	h.write(Magic)
+	// u2 version
+	h.u2(Version)
+	// u2 flags
+	h.u2(int(b.Flags()))
+	// u4 checksum
+	sum := [4]byte{}
+	binary.BigEndian.PutUint32(sum[0:], crc32.ChecksumIEEE(body.Bytes()))
+	h.write(sum[:])
+	h.write(body.Bytes())
+	return h.err
 }
 
-func (c *Compiler) Output() {
-	fmt.Print(c.Bytecode())
+// Decode reads the IR written by Encode from r. クラス名はIRに含まれないので空になる
+func Decode(r io.Reader) (*Bytecode, error) {
+	ir, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !IsIR(ir) {
+		return nil, &BytecodeErr{ErrIR, 0, "not a tarto IR file"}
+	}
+	if len(ir) < headerSize {
+		return nil, &BytecodeErr{ErrIR, len(ir), "unexpected end of IR"}
+	}
+	version := int(binary.BigEndian.Uint16(ir[4:]))
+	if version != Version {
+		return nil, &BytecodeErr{ErrIR, 4, fmt.Sprintf("unsupported IR version %d, expected %d", version, Version)}
+	}
+	flags := binary.BigEndian.Uint16(ir[6:])
+	if flags&^knownFlags != 0 {
+		return nil, &BytecodeErr{ErrIR, 6, fmt.Sprintf("unsupported flags %04x", flags)}
+	}
+	if crc32.ChecksumIEEE(ir[headerSize:]) != binary.BigEndian.Uint32(ir[8:]) {
+		return nil, &BytecodeErr{ErrIR, 8, "checksum mismatch, the IR is corrupted"}
+	}
+
+	body := bytes.NewReader(ir[headerSize:])
+	d := &decoder{r: body, off: headerSize}
+	b := &Bytecode{Classes: []obj.Class{}}
+	for i, n := 0, d.u1(); i < n && d.err == nil; i++ {
+		class := obj.Class{Index: i, NumInstanceVal: d.u1()}
+		class.ConstantPool = d.constants(d.u2())
+		b.Classes = append(b.Classes, class)
+	}
+	b.Constants = d.constants(d.u2())
+	b.Instructions = d.bytes(d.u2())
+	b.Handlers = d.handlers()
+	if flags&FlagDebug != 0 {
+		b.Debug = d.debug()
+		for _, f := range b.functions() {
+			f.Debug = d.debug()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if body.Len() > 0 {
+		return nil, &BytecodeErr{ErrIR, d.off, "trailing bytes"}
+	}
+	if b.Flags() != flags {
+		return nil, &BytecodeErr{ErrIR, 6, fmt.Sprintf("flags %04x do not match the program", flags)}
+	}
+	return b, nil
+}
+
+// IsIR reports whether b starts with the magic number of the IR
+func IsIR(b []byte) bool {
+	return bytes.HasPrefix(b, Magic)
 }
 
-func (c *Compiler) Dump() {
-	b := c.Bytecode()
+// Flags returns the feature flags of the header
+func (b *Bytecode) Flags() uint16 {
+	var flags uint16
+	for _, pool := range b.pools() {
+		for _, constant := range pool {
+			switch constant := constant.(type) {
+			case *obj.Integer:
+				if constant.Size() == 4 {
+					flags |= FlagInt32
+				}
+			case *obj.Range:
+				if constant.Size() == 8 {
+					flags |= FlagInt32
+				}
+			}
+		}
+	}
+	if b.Debug != nil {
+		flags |= FlagDebug
+	}
+	return flags
+}
+
+// StripDebug removes the debug info of the program and its functions
+func (b *Bytecode) StripDebug() {
+	b.Debug = nil
+	for _, f := range b.functions() {
+		f.Debug = nil
+	}
+}
+
+// functions returns the functions in the order they appear in the IR
+func (b *Bytecode) functions() []*obj.Function {
+	functions := []*obj.Function{}
+	pools := append(b.pools()[1:], b.Constants)
+	for _, pool := range pools {
+		for _, constant := range pool {
+			if f, ok := constant.(*obj.Function); ok {
+				functions = append(functions, f)
+			}
+		}
+	}
+	return functions
+}
+
+func (b *Bytecode) Output() {
+	fmt.Print(b.Hex())
+}
+
+func (b *Bytecode) Dump() {
+	h := b.Hex()
 	p := 0
 	size := 0
-	for p < len(b) {
+	for p < len(h) {
 		if size%16 == 0 {
 			if size != 0 {
 				fmt.Print("\n")
@@ -99,56 +280,349 @@ func (c *Compiler) Dump() {
 		if size%16 != 0 && size%8 == 0 {
 			fmt.Print(" ")
 		}
-		fmt.Print(b[p : p+2])
+		fmt.Print(h[p : p+2])
 		p += 2
 		size++
 	}
 }
 
-func toUint16(num int) [2]byte {
+// Magic is the first 4 bytes of the IR
+var Magic = []byte("TART")
+
+// Version is the format version of the IR. 形式を変えたら上げる
+const Version = 1
+
+// magic, version, flags, checksum
+const headerSize = 12
+
+// Define header flags
+const (
+	// 16bitに収まらない整数の定数がある
+	FlagInt32 uint16 = 1 << iota
+	// 行番号表と名前のデバッグ情報がある
+	FlagDebug
+
+	knownFlags = FlagInt32 | FlagDebug
+)
+
+// Define function flags
+const (
+	FuncVariadic byte = 1 << iota
+)
+
+func functionFlags(f *obj.Function) byte {
+	var flags byte
+	if f.Variadic {
+		flags |= FuncVariadic
+	}
+	return flags
+}
+
+// encoder writes big endian values to w. 最初に起きたエラーを保持し，以降は何も書かない
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *encoder) u1(num int) {
+	e.write([]byte{byte(num)})
+}
+
+func (e *encoder) u2(num int) {
 	b := [2]byte{}
 	binary.BigEndian.PutUint16(b[0:], uint16(num))
-	return b
+	e.write(b[:])
 }
 
-func writeConstant(cPool []obj.Object) string {
-	b := ""
+// int writes num as a two's complement integer of width bytes
+func (e *encoder) int(num int, width int) {
+	if width == 2 {
+		e.u2(num)
+		return
+	}
+	b := [4]byte{}
+	binary.BigEndian.PutUint32(b[0:], uint32(int32(num)))
+	e.write(b[:])
+}
+
+func (e *encoder) constants(cPool []obj.Object) {
 	for _, constant := range cPool {
 		switch constant := constant.(type) {
 		case *obj.Integer:
 			// u1
-			b += fmt.Sprintf("%02x", ConstInt)
+			e.u1(int(ConstInt))
 			// u2
-			b += fmt.Sprintf("%02x", toUint16(constant.Size()))
+			e.u2(constant.Size())
+			// s2 or s4 (幅はサイズで判別する)
+			e.int(constant.Value, constant.Size())
+		case *obj.Float:
+			// u1
+			e.u1(int(ConstFloat))
 			// u2
-			b += fmt.Sprintf("%02x", toUint16(constant.Value))
+			e.u2(constant.Size())
+			// f4
+			f := [4]byte{}
+			binary.BigEndian.PutUint32(f[0:], math.Float32bits(float32(constant.Value)))
+			e.write(f[:])
+		case *obj.JumpTable:
+			// u1
+			e.u1(int(ConstJumpTable))
+			// u2 サイズ
+			e.u2(constant.Size())
+			// s4 min
+			e.int(constant.Min, 4)
+			// u2 count
+			e.u2(len(constant.Targets))
+			for _, t := range constant.Targets {
+				e.u2(t)
+			}
+			// u2 default
+			e.u2(constant.Default)
 		case *obj.Bool:
 			// u1
-			b += fmt.Sprintf("%02x", ConstBool)
+			e.u1(int(ConstBool))
 			// u2
-			b += fmt.Sprintf("%02x", toUint16(constant.Size()))
-			// u2
-			b += fmt.Sprintf("%02x", constant.Value)
+			e.u2(constant.Size())
+			// u1
+			e.u1(constant.Value)
 		case *obj.Function:
 			// u1
-			b += fmt.Sprintf("%02x", ConstFunc)
+			e.u1(int(ConstFunc))
 			// u1 ダックタイプ用に関数名に一意なIDをふる
-			b += fmt.Sprintf("%02x", constant.Id)
+			e.u1(constant.Id)
+			// u1 引数の数
+			e.u1(constant.NumArg)
+			// u1 フラグ
+			e.u1(int(functionFlags(constant)))
+			// u1 戻り値の型
+			e.u1(constant.RetType)
+			// u2 戻り値の範囲・制約の定数index
+			e.u2(constant.RetLimit)
 			// u2 サイズ
-			b += fmt.Sprintf("%02x", toUint16(constant.Size()))
-			for _, bytecode := range constant.Instructions {
-				b += fmt.Sprintf("%02x", bytecode)
-			}
+			e.u2(constant.Size())
+			e.write(constant.Instructions)
+			e.handlers(constant.Handlers)
 		case *obj.Range:
 			// u1
-			b += fmt.Sprintf("%02x", ConstRange)
+			e.u1(int(ConstRange))
+			// u2 サイズ
+			e.u2(constant.Size())
+			// from, to (幅はサイズの半分)
+			e.int(constant.From, constant.Size()/2)
+			e.int(constant.To, constant.Size()/2)
+		case *obj.Constraint:
+			// u1
+			e.u1(int(ConstConstraint))
 			// u2 サイズ
-			b += fmt.Sprintf("%02x", toUint16(constant.Size()))
-			// from
-			b += fmt.Sprintf("%02x", toUint16(constant.From))
-			// to
-			b += fmt.Sprintf("%02x", toUint16(constant.To))
+			e.u2(constant.Size())
+			e.ranges(constant.Include)
+			e.ranges(constant.Exclude)
+			// u1 in count
+			e.u1(len(constant.In))
+			for _, v := range constant.In {
+				e.int(v, 4)
+			}
+			// u1 has predicate, u1 function id
+			if constant.Predicate < 0 {
+				e.write([]byte{0, 0})
+			} else {
+				e.write([]byte{1, byte(constant.Predicate)})
+			}
 		}
 	}
+}
+
+// debug writes the debug info of a function, or an empty one for nil
+func (e *encoder) debug(debug *obj.Debug) {
+	if debug == nil {
+		debug = &obj.Debug{}
+	}
+	e.name(debug.Name)
+	e.u1(len(debug.Locals))
+	for _, local := range debug.Locals {
+		e.name(local)
+	}
+	e.u2(len(debug.Lines))
+	for _, l := range debug.Lines {
+		e.u2(l.Offset)
+		e.u2(l.Line)
+	}
+}
+
+// name writes a string of up to 255 bytes with its length
+func (e *encoder) name(s string) {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	e.u1(len(s))
+	e.write([]byte(s))
+}
+
+func (e *encoder) ranges(ranges []obj.Range) {
+	// u1 count
+	e.u1(len(ranges))
+	for _, r := range ranges {
+		e.int(r.From, 4)
+		e.int(r.To, 4)
+	}
+}
+
+func (e *encoder) handlers(handlers []obj.Handler) {
+	// u1 count
+	e.u1(len(handlers))
+	for _, h := range handlers {
+		e.u2(h.Start)
+		e.u2(h.End)
+		e.u2(h.Target)
+	}
+}
+
+// decoder reads big endian values from r. エラー以降は0を返す
+type decoder struct {
+	r   io.Reader
+	off int
+	err error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return []byte{}
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = &BytecodeErr{ErrIR, d.off, "unexpected end of IR"}
+		return []byte{}
+	}
+	d.off += n
 	return b
 }
+
+func (d *decoder) u1() int {
+	b := d.bytes(1)
+	if len(b) < 1 {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (d *decoder) u2() int {
+	b := d.bytes(2)
+	if len(b) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// int reads a two's complement integer of width bytes
+func (d *decoder) int(width int) int {
+	if width == 2 {
+		return int(int16(d.u2()))
+	}
+	b := d.bytes(4)
+	if len(b) < 4 {
+		return 0
+	}
+	return int(int32(binary.BigEndian.Uint32(b)))
+}
+
+func (d *decoder) fail(msg string) {
+	if d.err == nil {
+		d.err = &BytecodeErr{ErrIR, d.off, msg}
+	}
+}
+
+func (d *decoder) constants(count int) []obj.Object {
+	pool := []obj.Object{}
+	for i := 0; i < count && d.err == nil; i++ {
+		switch ConstantType(d.u1()) {
+		case ConstInt:
+			size := d.u2()
+			if size != 2 && size != 4 {
+				d.fail(fmt.Sprintf("bad integer size %d", size))
+			}
+			pool = append(pool, &obj.Integer{Value: d.int(size)})
+		case ConstFloat:
+			d.u2()
+			f := math.Float32frombits(uint32(d.int(4)))
+			pool = append(pool, &obj.Float{Value: float64(f)})
+		case ConstJumpTable:
+			d.u2()
+			j := &obj.JumpTable{Min: d.int(4), Targets: []int{}}
+			for n := d.u2(); n > 0; n-- {
+				j.Targets = append(j.Targets, d.u2())
+			}
+			j.Default = d.u2()
+			pool = append(pool, j)
+		case ConstBool:
+			d.u2()
+			pool = append(pool, &obj.Bool{Value: d.u1()})
+		case ConstFunc:
+			f := &obj.Function{Id: d.u1(), NumArg: d.u1()}
+			f.Variadic = byte(d.u1())&FuncVariadic != 0
+			f.RetType = d.u1()
+			f.RetLimit = d.u2()
+			f.Instructions = d.bytes(d.u2())
+			f.Handlers = d.handlers()
+			pool = append(pool, f)
+		case ConstRange:
+			size := d.u2()
+			if size != 4 && size != 8 {
+				d.fail(fmt.Sprintf("bad range size %d", size))
+			}
+			pool = append(pool, &obj.Range{From: d.int(size / 2), To: d.int(size / 2)})
+		case ConstConstraint:
+			d.u2()
+			c := &obj.Constraint{Include: d.ranges(), Exclude: d.ranges(), In: []int{}}
+			for n := d.u1(); n > 0; n-- {
+				c.In = append(c.In, d.int(4))
+			}
+			has, id := d.u1(), d.u1()
+			c.Predicate = -1
+			if has != 0 {
+				c.Predicate = id
+			}
+			pool = append(pool, c)
+		default:
+			d.fail("undefined constant type")
+		}
+	}
+	return pool
+}
+
+func (d *decoder) ranges() []obj.Range {
+	ranges := []obj.Range{}
+	for n := d.u1(); n > 0; n-- {
+		ranges = append(ranges, obj.Range{From: d.int(4), To: d.int(4)})
+	}
+	return ranges
+}
+
+func (d *decoder) handlers() []obj.Handler {
+	handlers := []obj.Handler{}
+	for n := d.u1(); n > 0; n-- {
+		handlers = append(handlers, obj.Handler{Start: d.u2(), End: d.u2(), Target: d.u2()})
+	}
+	return handlers
+}
+
+func (d *decoder) debug() *obj.Debug {
+	debug := &obj.Debug{Name: d.name(), Locals: []string{}, Lines: []obj.Line{}}
+	for n := d.u1(); n > 0; n-- {
+		debug.Locals = append(debug.Locals, d.name())
+	}
+	for n := d.u2(); n > 0; n-- {
+		debug.Lines = append(debug.Lines, obj.Line{Offset: d.u2(), Line: d.u2()})
+	}
+	return debug
+}
+
+func (d *decoder) name() string {
+	return string(d.bytes(d.u1()))
+}
@@ -1,5 +1,7 @@
 package compiler
 
+import "github.com/takeru56/tcompiler/parser"
+
 type SymbolScope string
 
 const (
@@ -8,9 +10,12 @@ const (
 )
 
 type Symbol struct {
-	Name  string
-	Scope SymbolScope
-	Index int
+	Name       string
+	Scope      SymbolScope
+	Index      int
+	ValType    parser.IdentValType
+	ValLimit   parser.IntegerRangeLiteral
+	Constraint parser.ValConstraint
 }
 
 type SymbolTable struct {
@@ -25,19 +30,29 @@ func NewSymbolTable() *SymbolTable {
 }
 
 func (st *SymbolTable) DefineGlobal(name string) Symbol {
-	symbol := Symbol{Name: name, Scope: GlobalScope, Index: st.symbolCount}
+	symbol := Symbol{Name: name, Scope: GlobalScope, Index: st.symbolCount, ValType: parser.Any}
 	st.store[name] = symbol
 	st.symbolCount += 1
 	return symbol
 }
 
 func (st *SymbolTable) DefineLocal(name string) Symbol {
-	symbol := Symbol{Name: name, Scope: LocalScope, Index: st.symbolCount}
+	symbol := Symbol{Name: name, Scope: LocalScope, Index: st.symbolCount, ValType: parser.Any}
 	st.store[name] = symbol
 	st.symbolCount++
 	return symbol
 }
 
+// Constrain records the value constraint declared on ident for the symbol of the same name
+func (st *SymbolTable) Constrain(ident parser.IdentExpr) Symbol {
+	symbol := st.store[ident.Name]
+	symbol.ValType = ident.ValType
+	symbol.ValLimit = ident.ValLimit
+	symbol.Constraint = ident.Constraint
+	st.store[ident.Name] = symbol
+	return symbol
+}
+
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	sym, ok := st.store[name]
 	return sym, ok
@@ -115,3 +130,89 @@ func (mt *MethodTable) ResolveMethodId(name string) (int, bool) {
 	id, ok := mt.store[name]
 	return id, ok
 }
+
+// SignatureTable keeps the parameters of functions and methods
+// to resolve keyword and omitted arguments at compile time
+type SignatureTable struct {
+	funcs   map[string]parser.FunctionDef
+	methods map[string][]parser.FunctionDef
+	inits   map[string]parser.FunctionDef
+}
+
+func NewSignatureTable(program []parser.Node) *SignatureTable {
+	st := &SignatureTable{map[string]parser.FunctionDef{}, map[string][]parser.FunctionDef{}, map[string]parser.FunctionDef{}}
+	st.Add(program)
+	return st
+}
+
+// Add records the functions and methods defined by program
+func (st *SignatureTable) Add(program []parser.Node) {
+	for _, n := range program {
+		switch node := n.(type) {
+		case parser.FunctionDef:
+			st.funcs[node.Ident.Name] = node
+		case parser.ClassDef:
+			for _, m := range node.Methods {
+				if m.Ident.Name == "init" {
+					st.inits[node.Ident.Name] = m
+					continue
+				}
+				st.methods[m.Ident.Name] = append(st.methods[m.Ident.Name], m)
+			}
+		}
+	}
+}
+
+func (st *SignatureTable) ResolveFunc(name string) (parser.FunctionDef, bool) {
+	f, ok := st.funcs[name]
+	return f, ok
+}
+
+func (st *SignatureTable) ResolveInit(class string) (parser.FunctionDef, bool) {
+	f, ok := st.inits[class]
+	return f, ok
+}
+
+// ResolveMethod finds the signature of the method.
+// レシーバのクラスは静的に分からないので，同名のメソッドの引数がすべて一致するときだけ解決する
+func (st *SignatureTable) ResolveMethod(name string) (parser.FunctionDef, bool) {
+	ms, ok := st.methods[name]
+	if !ok {
+		return parser.FunctionDef{}, false
+	}
+	for _, m := range ms[1:] {
+		if !sameParams(ms[0], m) {
+			return parser.FunctionDef{}, false
+		}
+	}
+	return ms[0], true
+}
+
+func sameParams(a, b parser.FunctionDef) bool {
+	if len(a.Args) != len(b.Args) || a.Required() != b.Required() {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i].Name != b.Args[i].Name {
+			return false
+		}
+		if i < len(a.Defaults) && a.Defaults[i] != nil && literalValue(a.Defaults[i]) != literalValue(b.Defaults[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func literalValue(n parser.Node) interface{} {
+	switch node := n.(type) {
+	case parser.IntegerLiteral:
+		return node.Val
+	case parser.FloatLiteral:
+		return node.Val
+	case parser.BoolLiteral:
+		return node.Tok.Literal
+	case parser.IntegerRangeLiteral:
+		return [2]int{node.From.Val, node.To.Val}
+	}
+	return nil
+}
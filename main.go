@@ -1,37 +1,434 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
+	"strings"
 
 	"github.com/takeru56/tcompiler/compiler"
+	"github.com/takeru56/tcompiler/module"
 	"github.com/takeru56/tcompiler/parser"
 	"github.com/takeru56/tcompiler/token"
+	"github.com/takeru56/tcompiler/types"
+	"github.com/takeru56/tcompiler/vm"
 )
 
+// Define exit codes
+const (
+	exitOK = iota
+	// 構文・型・importのエラー
+	exitError
+	exitUsage
+	// 実行時に捕捉されなかったエラー
+	exitRuntime
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"build", "compile the program to IR", build},
+		{"run", "compile and run the program, or run an IR file (a last expression is printed for sources only)", run},
+		{"disasm", "print the compiled program as assembly", disasm},
+		{"check", "parse and type check the program only", check},
+		{"fmt", "print the program formatted", format},
+		{"repl", "read and run statements interactively", repl},
+	}
+}
+
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Missing argument error")
-	}
-	// from file
-	// bytes, err := ioutil.ReadFile("in.txt")
-	// if err != nil {
-	// 	panic(err)
-	// }
-	source := os.Args[1]
-	tok := token.New(source)
-	parser, err := parser.New(tok)
-	if err != nil {
-		fmt.Println(err.Error())
+	args := os.Args[1:]
+	if len(args) > 0 {
+		for _, cmd := range commands {
+			if args[0] == cmd.name {
+				os.Exit(cmd.run(args[1:]))
+			}
+		}
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			usage()
+			os.Exit(exitOK)
+		}
+	}
+	// サブコマンドがなければbuildとして扱う
+	os.Exit(build(args))
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] (-e source | file... | -)\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// input holds the flags shared by the commands to read sources
+type input struct {
+	flags *flag.FlagSet
+	expr  *string
+}
+
+func newInput(name string) *input {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	expr := fs.String("e", "", "compile the `source` given as an argument")
+	return &input{fs, expr}
+}
+
+// parse parses the flags and reads the sources, returning the exit code on failure
+func (in *input) parse(args []string) ([]module.Source, int) {
+	if err := in.flags.Parse(args); err != nil {
+		return nil, exitUsage
+	}
+	sources, err := readSources(*in.expr, in.flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitUsage
+	}
+	return sources, exitOK
+}
+
+func build(args []string) int {
+	in := newInput("build")
+	out := in.flags.String("o", "", "write the output to `file` instead of stdout")
+	emit := in.flags.String("emit", "hex", "output `format`: hex, bin, asm or ast")
+	debug := in.flags.Bool("g", false, "include the debug info in the IR")
+	sources, code := in.parse(args)
+	if code != exitOK {
+		return code
+	}
+	program, b, code := compile(sources)
+	if code != exitOK {
+		return code
+	}
+	if !*debug {
+		b.StripDebug()
+	}
+
+	var output []byte
+	switch *emit {
+	case "hex":
+		output = []byte(b.Hex())
+	case "bin":
+		var buf bytes.Buffer
+		if err := b.Encode(&buf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		output = buf.Bytes()
+	case "asm":
+		output = []byte(b.Disasm())
+	case "ast":
+		output = []byte(parser.Format(program))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %s for -emit\n", *emit)
+		return exitUsage
+	}
+	return write(*out, output)
+}
+
+func run(args []string) int {
+	in := newInput("run")
+	sources, code := in.parse(args)
+	if code != exitOK {
+		return code
+	}
+	program, b, code := load(sources)
+	if code != exitOK {
+		return code
+	}
+	machine := vm.New(b)
+	if err := machine.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntime
+	}
+	// IRには最後の文が式かどうかが残らないので，IRファイルの実行では値を表示しない
+	printResult(program, machine)
+	return exitOK
+}
+
+func disasm(args []string) int {
+	return build(append([]string{"-emit", "asm"}, args...))
+}
+
+func check(args []string) int {
+	in := newInput("check")
+	sources, code := in.parse(args)
+	if code != exitOK {
+		return code
+	}
+	_, code = analyze(sources)
+	return code
+}
+
+func format(args []string) int {
+	in := newInput("fmt")
+	overwrite := in.flags.Bool("w", false, "write the result to the source files")
+	sources, code := in.parse(args)
+	if code != exitOK {
+		return code
+	}
+	for _, src := range sources {
+		// コメントと空行を残す
+		t := token.FromFile(token.NewFile(src.Path, src.Text))
+		t.KeepTrivia = true
+		p, program, err := parseTokens(t)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		formatted := parser.FormatWithTrivia(program, p.Tokens())
+		if *overwrite && src.Path != "-" && *in.expr == "" {
+			err = ioutil.WriteFile(src.Path, []byte(formatted), 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return exitError
+			}
+			continue
+		}
+		fmt.Print(formatted)
+	}
+	return exitOK
+}
+
+func repl(args []string) int {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	s := newSession()
+	pending := ""
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print("> ")
+	for scanner.Scan() {
+		pending += scanner.Text() + "\n"
+		// 警告はevalで出すので，ここでは文が完結しているかだけを見る
+		p, err := parser.New(token.FromFile(token.NewFile("", pending)))
+		if err == nil {
+			_, err = p.Program()
+		}
+		if err != nil && incomplete(pending, err) {
+			fmt.Print("... ")
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			s.eval(pending)
+		}
+		pending = ""
+		fmt.Print("> ")
+	}
+	fmt.Println()
+	return exitOK
+}
+
+// session keeps the names and the global variables defined by the REPL inputs so far.
+// 入力ごとにその部分だけを検査・コンパイルして実行する
+type session struct {
+	linker   *module.Linker
+	checker  *types.Checker
+	compiler *compiler.Compiler
+	machine  *vm.VM
+	// 実行まで進んだ入力
+	history []string
+}
+
+func newSession() *session {
+	return &session{linker: module.NewLinker(), checker: types.NewChecker(), compiler: compiler.New()}
+}
+
+// eval runs src after the earlier inputs and prints the value of its last statement if it is an expression
+func (s *session) eval(src string) {
+	program, b, err := s.compile(src)
+	for _, w := range s.linker.Warnings() {
+		fmt.Fprintln(os.Stderr, w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		// 失敗した入力で定義された名前を忘れるために，実行済みの入力を検査し直す
+		s.rebuild()
+		return
+	}
+	s.history = append(s.history, src)
+	if s.machine == nil {
+		s.machine = vm.New(b)
+	}
+	if err := s.machine.Resume(b); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	p, err := parser.Program()
+	printResult(program, s.machine)
+}
+
+func (s *session) compile(src string) ([]parser.Node, *compiler.Bytecode, error) {
+	program, err := s.linker.Link([]module.Source{{Path: "repl" + module.Ext, Text: src}})
 	if err != nil {
-		fmt.Println(err.Error())
+		return nil, nil, err
+	}
+	if errs := s.checker.Check(program); len(errs) > 0 {
+		msgs := []string{}
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return nil, nil, errors.New(strings.Join(msgs, "\n"))
+	}
+	b, err := s.compiler.Compile(program)
+	return program, b, err
+}
+
+// rebuild makes the linker, checker and compiler again from the history without running it.
+// 同じ順にコンパイルすれば，グローバル変数の番号は実行中のVMと一致する
+func (s *session) rebuild() {
+	history := s.history
+	s.linker, s.checker, s.compiler = module.NewLinker(), types.NewChecker(), compiler.New()
+	for _, src := range history {
+		s.compile(src)
+	}
+}
+
+// incomplete reports whether err is caused by src ending in the middle of a statement
+func incomplete(src string, err error) bool {
+	var errs parser.ErrorList
+	if !errors.As(err, &errs) || len(errs) == 0 {
+		return false
+	}
+	// 文字列は行をまたげないので，字句エラーは続きを読んでも直らない
+	for _, pe := range errs {
+		if pe.Err != parser.ErrSyntax {
+			return false
+		}
+	}
+	// 最後のエラーが入力の終わりにあれば続きを待つ
+	return errs[len(errs)-1].L.Start >= len(strings.TrimRight(src, " \t\n"))
+}
+
+// analyze links and type checks the sources, printing the errors
+func analyze(sources []module.Source) ([]parser.Node, int) {
+	l := module.NewLinker()
+	program, err := l.Link(sources)
+	for _, w := range l.Warnings() {
+		fmt.Fprintln(os.Stderr, w)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, exitError
+	}
+	errs := types.Check(program)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		return nil, exitError
+	}
+	return program, exitOK
+}
+
+func compile(sources []module.Source) ([]parser.Node, *compiler.Bytecode, int) {
+	program, code := analyze(sources)
+	if code != exitOK {
+		return nil, nil, code
+	}
+	b, err := compiler.Exec(program)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, exitError
+	}
+	return program, b, exitOK
+}
+
+// load decodes an IR file given as the only source, or compiles the sources. IRファイルのときprogramはnil
+func load(sources []module.Source) ([]parser.Node, *compiler.Bytecode, int) {
+	if len(sources) != 1 {
+		return compile(sources)
+	}
+	ir := []byte(sources[0].Text)
+	// build が既定で出力する16進テキストのIRも受け付ける
+	if text, err := hex.DecodeString(strings.TrimSpace(sources[0].Text)); err == nil {
+		ir = text
+	}
+	if !compiler.IsIR(ir) {
+		return compile(sources)
+	}
+	b, err := compiler.Decode(bytes.NewReader(ir))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", sources[0].Path, err)
+		return nil, nil, exitError
+	}
+	return nil, b, exitOK
+}
+
+// printResult prints the value of the last statement if it is an expression
+func printResult(program []parser.Node, machine *vm.VM) {
+	if len(program) == 0 || machine.Result() == nil {
 		return
 	}
-	c := compiler.Exec(p)
-	c.Output()
-	// c.Dump()
+	if _, ok := program[len(program)-1].(parser.Expr); ok {
+		fmt.Println(machine.Result().Inspect())
+	}
+}
+
+func parseTokens(t *token.Tokenizer) (*parser.Parser, []parser.Node, error) {
+	p, err := parser.New(t)
+	if err != nil {
+		return nil, nil, err
+	}
+	program, err := p.Program()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 入力途中のREPLで繰り返さないように，エラーがないときだけ警告を出す
+	for _, w := range p.Warnings() {
+		fmt.Fprintln(os.Stderr, w)
+	}
+	return p, program, nil
+}
+
+func write(path string, b []byte) int {
+	if path == "" {
+		os.Stdout.Write(b)
+		return exitOK
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+// readSources reads the files in paths, or stdin for "-". -eで渡されたソースのimportはカレントディレクトリから解決する
+func readSources(expr string, paths []string) ([]module.Source, error) {
+	if expr != "" {
+		if len(paths) > 0 {
+			return nil, fmt.Errorf("cannot compile files with -e")
+		}
+		return []module.Source{{Path: "main" + module.Ext, Text: expr}}, nil
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("Missing argument error")
+	}
+	sources := []module.Source{}
+	for _, path := range paths {
+		var b []byte
+		var err error
+		if path == "-" {
+			b, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			b, err = ioutil.ReadFile(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, module.Source{Path: path, Text: string(b)})
+	}
+	return sources, nil
 }
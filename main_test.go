@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// capture runs fn reading stdin and returns what it wrote to stdout and stderr with its exit code
+func capture(t *testing.T, stdin string, fn func() int) (string, string, int) {
+	dir, err := ioutil.TempDir("", "tcompiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "stdin")
+	if err := ioutil.WriteFile(in, []byte(stdin), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []*os.File{}
+	for _, path := range []string{in, filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")} {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	stdinOrig, stdoutOrig, stderrOrig := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	code := fn()
+	os.Stdin, os.Stdout, os.Stderr = stdinOrig, stdoutOrig, stderrOrig
+
+	out, _ := ioutil.ReadFile(files[1].Name())
+	errOut, _ := ioutil.ReadFile(files[2].Name())
+	return string(out), string(errOut), code
+}
+
+func TestBuildRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcompiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "ok.t")
+	bin := filepath.Join(dir, "ok.bin")
+	hex := filepath.Join(dir, "ok.hex")
+	if err := ioutil.WriteFile(src, []byte("def f(x)\n  return x * 2\nend\nf(21)\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cmd    func([]string) int
+		args   []string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{run, []string{src}, "42\n", "", exitOK},
+		{run, []string{"-e", "a = 1"}, "", "", exitOK},
+		{build, []string{"-emit", "bin", "-o", bin, src}, "", "", exitOK},
+		{build, []string{"-o", hex, src}, "", "", exitOK},
+		// IRファイルでは最後の式の値を表示しない
+		{run, []string{bin}, "", "", exitOK},
+		{build, []string{"-emit", "ast", "-e", "x=1+2"}, "x = 1 + 2\n", "", exitOK},
+		{run, []string{"-e", "1 / 0"}, "", "Runtime error: division by zero\n\tat main line 1\n", exitRuntime},
+		{build, []string{"-e", "x = 1 +"}, "", "main.t:1:8: Syntax error: expected expression, found end of input\nx = 1 +\n       ^\n", exitError},
+		{run, []string{"-e", "x = y"}, "", "main.t:1:5: Undefined error: undefined variable y\nx = y\n    ^\n", exitError},
+		// 型検査で分からない呼び出しのエラーもコマンドを止めずに報告する
+		{run, []string{"-e", "def f(a) return a end\ng = f\ng(a: 1)"}, "", "main.t:3:3: Call error: cannot resolve keyword arguments for g\ng(a: 1)\n  ^\n", exitError},
+		{build, []string{"-emit", "exe", "-e", "1"}, "", "unknown format exe for -emit\n", exitUsage},
+		{run, []string{}, "", "Missing argument error\n", exitUsage},
+	}
+
+	for _, c := range cases {
+		stdout, stderr, code := capture(t, "", func() int { return c.cmd(c.args) })
+		if stdout != c.stdout || stderr != c.stderr || code != c.code {
+			t.Errorf("%v: expected %q, %q and %d, got %q, %q and %d", c.args, c.stdout, c.stderr, c.code, stdout, stderr, code)
+		}
+	}
+}
+
+func TestRepl(t *testing.T) {
+	input := `a = 1
+def f(x)
+  return x + a
+end
+a = a + 1
+f(1)
+x = 1 + true
+x
+b = 1 / 0
+a
+s = "ab
+`
+	stdout, stderr, code := capture(t, input, func() int { return repl(nil) })
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d", exitOK, code)
+	}
+	// 値は入力ごとに1度だけ表示し，エラーの後も続ける
+	values := []string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimLeft(line, "> .")
+		if line != "" {
+			values = append(values, line)
+		}
+	}
+	if strings.Join(values, " ") != "3 2" {
+		t.Errorf("expected the values 3 2, got %q", stdout)
+	}
+	for _, msg := range []string{
+		"repl.t:1:5: Type error: invalid operand bool for +",
+		"repl.t:1:1: Undefined error: undefined variable x",
+		"Runtime error: division by zero",
+		"1:5: Syntax error, undefined token",
+	} {
+		if !strings.Contains(stderr, msg) {
+			t.Errorf("expected %q in the errors, got %q", msg, stderr)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
+)
+
+// Ext is the extension of a source file, added to import paths without one
+const Ext = ".t"
+
+type ModuleErr struct {
+	Err  error
+	Path string
+	Msg  string
+}
+
+// custom error
+var (
+	ErrImport    = errors.New("Import error")
+	ErrCycle     = errors.New("Import cycle error")
+	ErrUndefined = errors.New("Undefined error")
+)
+
+func (me *ModuleErr) Error() string {
+	if me.Msg == "" {
+		return fmt.Sprintf("%s: %v", me.Path, me.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", me.Path, me.Err, me.Msg)
+}
+
+// Module is a parsed source file. 他のモジュールから見える名前は Name + "." + 元の名前 になる
+type Module struct {
+	Name    string
+	Path    string
+	Program []parser.Node
+	// トップレベルで定義された名前
+	names map[string]bool
+	// import名から読み込んだモジュールへ
+	imports map[string]*Module
+}
+
+// Linker loads modules once each and links them into one program
+type Linker struct {
+	modules map[string]*Module
+	// 依存されるものが先に並ぶ
+	order []*Module
+	// importの解決中のモジュール（循環の検出用）
+	loading []string
+	// 構文の警告
+	warnings []*parser.ParseErr
+	// 前のLinkで結合済みのモジュールの数
+	linked int
+}
+
+func NewLinker() *Linker {
+	return &Linker{modules: map[string]*Module{}, order: []*Module{}, loading: []string{}}
+}
+
+// Source is a file given as a root of the program
+type Source struct {
+	Path string
+	Text string
+}
+
+// Load reads the file at path as the main module and links it with its imports
+func Load(path string) ([]parser.Node, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &ModuleErr{ErrImport, path, err.Error()}
+	}
+	return LoadSource(string(src), path)
+}
+
+// LoadSource links src as the main module. importはpathのあるディレクトリから解決する
+func LoadSource(src string, path string) ([]parser.Node, error) {
+	return Link([]Source{{path, src}})
+}
+
+// Link links the sources in order with their imports into one program.
+// 各sourceの名前は修飾されず，同じグローバルな名前空間を共有する
+func Link(sources []Source) ([]parser.Node, error) {
+	return NewLinker().Link(sources)
+}
+
+// Link links the sources like the function Link, keeping the warnings for Warnings.
+// 2回目以降は，前のLinkで読み込んだモジュールを除いたものを返す（REPL用）
+func (l *Linker) Link(sources []Source) ([]parser.Node, error) {
+	l.warnings = nil
+	l.loading = l.loading[:0]
+	for _, src := range sources {
+		_, err := l.load(src.Text, filepath.Clean(src.Path), "")
+		if err != nil {
+			l.rollback()
+			return nil, err
+		}
+	}
+	program, err := l.link()
+	if err != nil {
+		l.rollback()
+		return nil, err
+	}
+	l.linked = len(l.order)
+	return program, nil
+}
+
+// rollback forgets the modules loaded by the failed Link
+func (l *Linker) rollback() {
+	for _, m := range l.order[l.linked:] {
+		delete(l.modules, m.Path)
+	}
+	l.order = l.order[:l.linked]
+}
+
+// Warnings returns the syntax warnings of the modules loaded by the last Link
+func (l *Linker) Warnings() []*parser.ParseErr {
+	return l.warnings
+}
+
+func (l *Linker) load(src string, path string, name string) (*Module, error) {
+	// 構文エラーの位置はファイル名を含む
+	program, warnings, err := parse(src, path)
+	if err != nil {
+		return nil, err
+	}
+	l.warnings = append(l.warnings, warnings...)
+	m := &Module{Name: name, Path: path, Program: program, names: topLevelNames(program), imports: map[string]*Module{}}
+	l.loading = append(l.loading, path)
+	for _, n := range program {
+		imp, ok := n.(parser.ImportStmt)
+		if !ok {
+			continue
+		}
+		dep, err := l.resolve(path, imp.Path)
+		if err != nil {
+			return nil, err
+		}
+		m.imports[dep.Name] = dep
+	}
+	l.loading = l.loading[:len(l.loading)-1]
+	l.order = append(l.order, m)
+	return m, nil
+}
+
+// resolve loads the module imported as target from the file at from, unless it has been loaded
+func (l *Linker) resolve(from string, target string) (*Module, error) {
+	path := filepath.Join(filepath.Dir(from), target)
+	if filepath.Ext(path) == "" {
+		path += Ext
+	}
+	for i, p := range l.loading {
+		if p == path {
+			cycle := append(append([]string{}, l.loading[i:]...), path)
+			return nil, &ModuleErr{ErrCycle, from, strings.Join(cycle, " -> ")}
+		}
+	}
+	if m, ok := l.modules[path]; ok {
+		return m, nil
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, m := range l.modules {
+		if m.Name == name {
+			return nil, &ModuleErr{ErrImport, from, fmt.Sprintf("module %s is imported from both %s and %s", name, m.Path, path)}
+		}
+	}
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &ModuleErr{ErrImport, from, fmt.Sprintf("cannot read module %s", target)}
+	}
+	m, err := l.load(string(src), path, name)
+	if err != nil {
+		return nil, err
+	}
+	l.modules[path] = m
+	return m, nil
+}
+
+// link renames the names of each module and concatenates them in dependency order
+func (l *Linker) link() ([]parser.Node, error) {
+	program := []parser.Node{}
+	for _, m := range l.order[l.linked:] {
+		r := &renamer{m: m}
+		for _, n := range m.Program {
+			if _, ok := n.(parser.ImportStmt); ok {
+				continue
+			}
+			program = append(program, r.stmt(n))
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	return program, nil
+}
+
+func parse(src string, path string) ([]parser.Node, []*parser.ParseErr, error) {
+	p, err := parser.New(token.FromFile(token.NewFile(path, src)))
+	if err != nil {
+		return nil, nil, err
+	}
+	program, err := p.Program()
+	return program, p.Warnings(), err
+}
+
+// topLevelNames collects the functions, classes and globals defined by program
+func topLevelNames(program []parser.Node) map[string]bool {
+	names := map[string]bool{}
+	var collect func(nodes []parser.Node)
+	collect = func(nodes []parser.Node) {
+		for _, n := range nodes {
+			switch n := n.(type) {
+			case parser.FunctionDef:
+				names[n.Ident.Name] = true
+			case parser.ClassDef:
+				names[n.Ident.Name] = true
+			case parser.AssignStmt:
+				names[n.Ident.Name] = true
+			case parser.MultiAssignStmt:
+				for _, ident := range n.Idents {
+					names[ident.Name] = true
+				}
+			// 制御構文の中の代入もグローバル変数になる
+			case parser.IfStmt:
+				collect(n.Block.Nodes)
+			case parser.WhileStmt:
+				collect(n.Block.Nodes)
+			case parser.CaseStmt:
+				for _, when := range n.Whens {
+					collect(when.Block.Nodes)
+				}
+				if n.Else != nil {
+					collect(n.Else.Nodes)
+				}
+			case parser.BeginStmt:
+				collect(n.Block.Nodes)
+				if n.Ident != nil {
+					names[n.Ident.Name] = true
+				}
+				if n.Rescue != nil {
+					collect(n.Rescue.Nodes)
+				}
+				if n.Ensure != nil {
+					collect(n.Ensure.Nodes)
+				}
+			}
+		}
+	}
+	collect(program)
+	return names
+}
@@ -0,0 +1,101 @@
+package module
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/takeru56/tcompiler/compiler"
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/vm"
+)
+
+func TestLoad(t *testing.T) {
+	program, err := Load("testdata/main.t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"util.twice", "geometry.scale", "geometry.area", "geometry.Point", "a", "p", "b", "c"}
+	if len(program) != len(expected) {
+		t.Fatalf("wrong number of statements: %d", len(program))
+	}
+	for i, n := range program {
+		name := ""
+		switch n := n.(type) {
+		case parser.FunctionDef:
+			name = n.Ident.Name
+		case parser.ClassDef:
+			name = n.Ident.Name
+		case parser.AssignStmt:
+			name = n.Ident.Name
+		}
+		if name != expected[i] {
+			fmt.Println("expected: " + expected[i])
+			fmt.Println("but actual: " + name)
+			t.Error("wrong linked name\n")
+		}
+	}
+
+	// モジュール内の参照と他のモジュールへの参照が解決されている
+	area := program[2].(parser.FunctionDef)
+	ret := area.Block.Nodes[0].(parser.ReturnStmt).Expr.(parser.InfixExpr)
+	if ret.Left.(parser.CallExpr).Ident.Name != "util.twice" || ret.Right.(parser.IdentExpr).Name != "geometry.scale" {
+		t.Error("references in a module are not resolved\n")
+	}
+	p := program[5].(parser.AssignStmt)
+	if p.Expr.(parser.InstantiationExpr).Ident.Name != "geometry.Point" {
+		t.Error("the class of a module is not resolved\n")
+	}
+}
+
+// TestLoadConstraint runs an imported function whose constraints check with a function of its module
+func TestLoadConstraint(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{`import "lib/odd" odd.f(3)`, "3"},
+		{`import "lib/odd" odd.f(4)`, "Runtime error: 4 violates {include: 0..9, check: 1}\n\tat odd.f line 5\n\tat main line 1"},
+	}
+
+	for _, c := range cases {
+		program, err := LoadSource(c.input, "testdata/main.t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := compiler.Exec(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		machine := vm.New(b)
+		actual := ""
+		if err := machine.Run(); err != nil {
+			actual = err.Error()
+		} else {
+			actual = machine.Result().Inspect()
+		}
+		if actual != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.input, c.expected, actual)
+		}
+	}
+}
+
+func TestLoadErr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{`import "lib/geometry" geometry.nope(1)`, "testdata/main.t: Undefined error: undefined geometry.nope"},
+		{`import "lib/nothing"`, "testdata/main.t: Import error: cannot read module lib/nothing"},
+		{"import \"lib/util\"\nx = $", "testdata/main.t:2:5: Syntax error, undefined token\nx = $\n    ^"},
+		{`import "cycle_a"`, "testdata/cycle_b.t: Import cycle error: testdata/cycle_a.t -> testdata/cycle_b.t -> testdata/cycle_a.t"},
+	}
+
+	for _, c := range cases {
+		_, err := LoadSource(c.input, "testdata/main.t")
+		if err == nil || err.Error() != c.expected {
+			fmt.Println("expected: " + c.expected)
+			fmt.Println("but actual: ", err)
+			t.Error("wrong module error\n")
+		}
+	}
+}
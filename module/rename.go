@@ -0,0 +1,232 @@
+package module
+
+import (
+	"fmt"
+
+	"github.com/takeru56/tcompiler/parser"
+)
+
+// renamer qualifies the top level names of a module and resolves references to imported modules
+type renamer struct {
+	m *Module
+	// 関数の引数はトップレベルの名前を隠す
+	locals map[string]bool
+	err    error
+}
+
+func (r *renamer) stmt(n parser.Node) parser.Node {
+	switch node := n.(type) {
+	case parser.FunctionDef:
+		return r.function(node, true)
+	case parser.ClassDef:
+		node.Ident = r.ident(node.Ident)
+		methods := []parser.FunctionDef{}
+		for _, m := range node.Methods {
+			methods = append(methods, r.function(m, false))
+		}
+		node.Methods = methods
+		return node
+	case parser.AssignStmt:
+		node.Ident = r.ident(node.Ident)
+		node.Expr = r.expr(node.Expr)
+		return node
+	case parser.MultiAssignStmt:
+		idents := []parser.IdentExpr{}
+		for _, ident := range node.Idents {
+			idents = append(idents, r.ident(ident))
+		}
+		node.Idents = idents
+		node.Expr = r.expr(node.Expr)
+		return node
+	case parser.IfStmt:
+		node.Condition = r.expr(node.Condition)
+		node.Block = r.block(node.Block)
+		return node
+	case parser.WhileStmt:
+		node.Condition = r.expr(node.Condition)
+		node.Block = r.block(node.Block)
+		return node
+	case parser.CaseStmt:
+		node.Subject = r.expr(node.Subject)
+		whens := []parser.WhenClause{}
+		for _, when := range node.Whens {
+			when.Block = r.block(when.Block)
+			whens = append(whens, when)
+		}
+		node.Whens = whens
+		if node.Else != nil {
+			block := r.block(*node.Else)
+			node.Else = &block
+		}
+		return node
+	case parser.BeginStmt:
+		node.Block = r.block(node.Block)
+		if node.Ident != nil {
+			ident := r.ident(*node.Ident)
+			node.Ident = &ident
+		}
+		if node.Rescue != nil {
+			block := r.block(*node.Rescue)
+			node.Rescue = &block
+		}
+		if node.Ensure != nil {
+			block := r.block(*node.Ensure)
+			node.Ensure = &block
+		}
+		return node
+	case parser.ReturnStmt:
+		node.Expr = r.expr(node.Expr)
+		return node
+	case parser.RaiseStmt:
+		node.Expr = r.expr(node.Expr)
+		return node
+	}
+	return r.expr(n)
+}
+
+func (r *renamer) block(b parser.BlockStmt) parser.BlockStmt {
+	nodes := []parser.Node{}
+	for _, n := range b.Nodes {
+		nodes = append(nodes, r.stmt(n))
+	}
+	return parser.BlockStmt{Nodes: nodes}
+}
+
+// function renames the body of f, and its name unless f is a method
+func (r *renamer) function(f parser.FunctionDef, global bool) parser.FunctionDef {
+	if global {
+		f.Ident = r.ident(f.Ident)
+	}
+	args := []parser.IdentExpr{}
+	for _, arg := range f.Args {
+		arg.Constraint = r.constraint(arg.Constraint)
+		args = append(args, arg)
+	}
+	f.Args = args
+	f.Result.Constraint = r.constraint(f.Result.Constraint)
+	outer := r.locals
+	r.locals = map[string]bool{}
+	for name := range outer {
+		r.locals[name] = true
+	}
+	for _, arg := range f.Args {
+		r.locals[arg.Name] = true
+	}
+	f.Block = r.block(f.Block)
+	r.locals = outer
+	return f
+}
+
+func (r *renamer) ident(i parser.IdentExpr) parser.IdentExpr {
+	i.Constraint = r.constraint(i.Constraint)
+	if r.m.Name == "" || i.FSelf || r.locals[i.Name] || !r.m.names[i.Name] {
+		return i
+	}
+	i.Name = r.m.Name + "." + i.Name
+	return i
+}
+
+// constraint qualifies the predicate of c if it is a function of the module
+func (r *renamer) constraint(c parser.ValConstraint) parser.ValConstraint {
+	if r.m.Name != "" && r.m.names[c.Predicate] {
+		c.Predicate = r.member(r.m, c.Predicate)
+	}
+	return c
+}
+
+func (r *renamer) expr(n parser.Node) parser.Node {
+	switch node := n.(type) {
+	case parser.IdentExpr:
+		return r.ident(node)
+	case parser.InfixExpr:
+		node.Left = r.expr(node.Left)
+		node.Right = r.expr(node.Right)
+		return node
+	case parser.CallExpr:
+		node.Ident = r.ident(node.Ident)
+		node.Args = r.args(node.Args)
+		return node
+	case parser.InstantiationExpr:
+		node.Ident = r.ident(node.Ident)
+		node.Args = r.args(node.Args)
+		return node
+	case parser.KeywordArg:
+		node.Expr = r.expr(node.Expr)
+		return node
+	case parser.SplatExpr:
+		node.Expr = r.expr(node.Expr)
+		return node
+	case parser.TupleExpr:
+		node.Elems = r.args(node.Elems)
+		return node
+	case parser.CallMethodExpr:
+		if recv, ok := node.Receiver.(parser.IdentExpr); ok && !recv.FSelf && !r.locals[recv.Name] && !r.m.names[recv.Name] {
+			if dep, ok := r.m.imports[recv.Name]; ok {
+				return r.qualify(dep, node.Method)
+			}
+		}
+		node.Receiver = r.expr(node.Receiver)
+		node.Method = r.method(node.Method)
+		return node
+	}
+	return n
+}
+
+func (r *renamer) args(args []parser.Node) []parser.Node {
+	renamed := []parser.Node{}
+	for _, arg := range args {
+		renamed = append(renamed, r.expr(arg))
+	}
+	return renamed
+}
+
+// method renames the arguments of a method call but not the method name
+func (r *renamer) method(n parser.Node) parser.Node {
+	switch node := n.(type) {
+	case parser.CallExpr:
+		node.Args = r.args(node.Args)
+		return node
+	case parser.CallMethodExpr:
+		node.Receiver = r.method(node.Receiver)
+		node.Method = r.method(node.Method)
+		return node
+	}
+	return n
+}
+
+// qualify resolves n, written after "dep.", to a name defined by dep
+func (r *renamer) qualify(dep *Module, n parser.Node) parser.Node {
+	switch node := n.(type) {
+	case parser.IdentExpr:
+		node.Name = r.member(dep, node.Name)
+		return node
+	case parser.CallExpr:
+		node.Ident.Name = r.member(dep, node.Ident.Name)
+		node.Args = r.args(node.Args)
+		return node
+	case parser.InstantiationExpr:
+		node.Ident.Name = r.member(dep, node.Ident.Name)
+		node.Args = r.args(node.Args)
+		return node
+	case parser.CallMethodExpr:
+		node.Receiver = r.qualify(dep, node.Receiver)
+		node.Method = r.method(node.Method)
+		return node
+	}
+	r.fail(fmt.Sprintf("cannot use module %s as a value", dep.Name))
+	return n
+}
+
+func (r *renamer) member(dep *Module, name string) string {
+	if !dep.names[name] {
+		r.fail(fmt.Sprintf("undefined %s.%s", dep.Name, name))
+	}
+	return dep.Name + "." + name
+}
+
+// fail records the first error found
+func (r *renamer) fail(msg string) {
+	if r.err == nil {
+		r.err = &ModuleErr{ErrUndefined, r.m.Path, msg}
+	}
+}
@@ -0,0 +1,13 @@
+import "util"
+scale = 2
+def area(w, h)
+  return util.twice(w * h) * scale
+end
+class Point
+  def init(x)
+    self.x = x
+  end
+  def far()
+    return area(self.x, 1)
+  end
+end
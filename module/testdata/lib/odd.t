@@ -0,0 +1,8 @@
+def valid(v)
+  return v % 2 == 1
+end
+
+def f(x: {include: 0..9, check: valid}): {check: valid}
+  y: {check: valid} = x
+  return y
+end
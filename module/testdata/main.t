@@ -0,0 +1,5 @@
+import "lib/geometry"
+a = geometry.area(2, 3)
+p = geometry.Point(4)
+b = p.far()
+c = geometry.scale
@@ -2,6 +2,9 @@ package obj
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
 	"github.com/takeru56/tcompiler/code"
 )
@@ -9,11 +12,18 @@ import (
 type ObjectType string
 
 const (
-	IntegerObj  = "INTEGER"
-	FunctionObj = "FUNCTION"
-	ClassObj    = "CLASS"
-	BoolObj     = "BOOL"
-	RangeObj    = "RANGE"
+	IntegerObj    = "INTEGER"
+	FloatObj      = "FLOAT"
+	FunctionObj   = "FUNCTION"
+	ClassObj      = "CLASS"
+	BoolObj       = "BOOL"
+	RangeObj      = "RANGE"
+	ConstraintObj = "CONSTRAINT"
+	JumpTableObj  = "JUMP_TABLE"
+	ErrorObj      = "ERROR"
+	InstanceObj   = "INSTANCE"
+	TupleObj      = "TUPLE"
+	NilObj        = "NIL"
 )
 
 type Object interface {
@@ -29,14 +39,41 @@ type Integer struct {
 func (i *Integer) Type() ObjectType { return IntegerObj }
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 
-// TODO: のちほど32bitに対応する
-// ひとまず2byte(16bit)で表現
-func (i *Integer) Size() int { return 2 }
+// 符号付き32bit整数
+// 16bitに収まる値は2byte，それ以外は4byteで表現する
+func (i *Integer) Size() int { return intWidth(i.Value) }
+
+func intWidth(v int) int {
+	if math.MinInt16 <= v && v <= math.MaxInt16 {
+		return 2
+	}
+	return 4
+}
+
+// Float is a IEEE 754 single precision number
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FloatObj }
+func (f *Float) Inspect() string  { return strconv.FormatFloat(f.Value, 'g', -1, 32) }
+
+// 4byte(binary32)で表現
+func (f *Float) Size() int { return 4 }
 
 type Function struct {
 	Id           int
 	Instructions code.Instructions
 	NumArg       int
+	// 最後の引数が残りの引数をタプルで受け取る
+	Variadic bool
+	// 戻り値の型と，範囲・制約の定数のindex（なければ0）
+	RetType  int
+	RetLimit int
+	// 例外表. 内側のbeginのものが先に並ぶ
+	Handlers []Handler
+	// デバッグ情報（なければnil）
+	Debug *Debug
 }
 
 func (f *Function) Type() ObjectType { return FunctionObj }
@@ -63,7 +100,12 @@ type Bool struct {
 }
 
 func (b *Bool) Type() ObjectType { return BoolObj }
-func (b *Bool) Inspect() string  { return fmt.Sprintf("%d", b.Value) }
+func (b *Bool) Inspect() string {
+	if b.Value == 0 {
+		return "false"
+	}
+	return "true"
+}
 
 func (b *Bool) Size() int { return 1 }
 
@@ -75,4 +117,168 @@ type Range struct {
 func (r *Range) Type() ObjectType { return RangeObj }
 func (r *Range) Inspect() string  { return fmt.Sprintf("%d..%d", r.From, r.To) }
 
-func (r *Range) Size() int { return 4 }
+// from, toを同じ幅で表現する
+func (r *Range) Size() int {
+	if intWidth(r.From) == 4 || intWidth(r.To) == 4 {
+		return 8
+	}
+	return 4
+}
+
+// Constraint describes the values a checked store accepts.
+// Predicate is the function id of the predicate method, or -1 if none
+type Constraint struct {
+	Include   []Range
+	Exclude   []Range
+	In        []int
+	Predicate int
+}
+
+func (c *Constraint) Type() ObjectType { return ConstraintObj }
+func (c *Constraint) Inspect() string {
+	clauses := []string{}
+	ranges := func(key string, rs []Range) {
+		if len(rs) == 0 {
+			return
+		}
+		s := []string{}
+		for _, r := range rs {
+			s = append(s, r.Inspect())
+		}
+		clauses = append(clauses, key+": "+strings.Join(s, ", "))
+	}
+	ranges("include", c.Include)
+	ranges("exclude", c.Exclude)
+	if len(c.In) > 0 {
+		clauses = append(clauses, fmt.Sprintf("in: %v", c.In))
+	}
+	if c.Predicate >= 0 {
+		clauses = append(clauses, fmt.Sprintf("check: %d", c.Predicate))
+	}
+	return "{" + strings.Join(clauses, ", ") + "}"
+}
+
+// 各要素数(1byte)・範囲(8byte)・値(4byte)・predicateの有無とid(各1byte)
+func (c *Constraint) Size() int {
+	return 1 + 8*len(c.Include) + 1 + 8*len(c.Exclude) + 1 + 4*len(c.In) + 2
+}
+
+// JumpTable maps the integers from Min to the positions to jump to.
+// 表にない値はDefaultへ飛ぶ
+type JumpTable struct {
+	Min     int
+	Targets []int
+	Default int
+}
+
+func (j *JumpTable) Type() ObjectType { return JumpTableObj }
+func (j *JumpTable) Inspect() string {
+	return fmt.Sprintf("from %d %v default %d", j.Min, j.Targets, j.Default)
+}
+
+// min(4byte)・要素数(2byte)・飛び先(各2byte)・既定の飛び先(2byte)
+func (j *JumpTable) Size() int { return 4 + 2 + 2*len(j.Targets) + 2 }
+
+// Handler is an entry of the exception table of a function.
+// Start以上End未満の位置で送出されたエラーはスタックを関数の入口の高さに戻して積み，Targetへ飛ぶ
+type Handler struct {
+	Start  int
+	End    int
+	Target int
+}
+
+// Debug maps the instructions of a function back to the source
+type Debug struct {
+	Name string
+	// 引数とローカル変数の名前（トップレベルではグローバル変数）. indexの順に並ぶ
+	Locals []string
+	// 位置の昇順. 各行は次の要素の位置の手前まで続く
+	Lines []Line
+}
+
+// Line tells that the instructions from Offset come from the source line Line
+type Line struct {
+	Offset int
+	Line   int
+}
+
+// LineAt returns the source line of the instruction at offset, or 0 if unknown
+func (d *Debug) LineAt(offset int) int {
+	line := 0
+	for _, l := range d.Lines {
+		if l.Offset > offset {
+			break
+		}
+		line = l.Line
+	}
+	return line
+}
+
+// ErrorCode tells what raised an error
+type ErrorCode int
+
+// Define error codes
+const (
+	ErrRaised ErrorCode = iota
+	ErrZeroDivision
+	ErrConstraint
+	ErrArity
+	ErrType
+	ErrStackOverflow
+)
+
+// Error is raised by the raise statement or by the VM on a runtime failure.
+// raiseされた値はValueに，VMが送出したときはその理由がMsgに入る
+type Error struct {
+	Code  ErrorCode
+	Value Object
+	Msg   string
+}
+
+func (e *Error) Type() ObjectType { return ErrorObj }
+func (e *Error) Inspect() string {
+	if e.Value != nil {
+		return fmt.Sprintf("error(%d: %s)", e.Code, e.Value.Inspect())
+	}
+	if e.Msg != "" {
+		return fmt.Sprintf("error(%d: %s)", e.Code, e.Msg)
+	}
+	return fmt.Sprintf("error(%d)", e.Code)
+}
+
+// 実行時にしか作られないので定数プールには現れない
+func (e *Error) Size() int { return 0 }
+
+// 以下は実行時にのみ作られる
+
+// Instance is an object of a class
+type Instance struct {
+	Class *Class
+	Vals  []Object
+}
+
+func (i *Instance) Type() ObjectType { return InstanceObj }
+func (i *Instance) Inspect() string  { return fmt.Sprintf("%s%p", i.Class.Name, i) }
+func (i *Instance) Size() int        { return 0 }
+
+// Tuple holds multiple values, made by a, b or a rest parameter
+type Tuple struct {
+	Elems []Object
+}
+
+func (t *Tuple) Type() ObjectType { return TupleObj }
+func (t *Tuple) Inspect() string {
+	s := []string{}
+	for _, e := range t.Elems {
+		s = append(s, e.Inspect())
+	}
+	return strings.Join(s, ", ")
+}
+func (t *Tuple) Size() int { return 0 }
+
+// Nil is returned by a function without a return value
+type Nil struct{}
+
+func (n *Nil) Type() ObjectType { return NilObj }
+func (n *Nil) Inspect() string  { return "nil" }
+func (n *Nil) Size() int        { return 0 }
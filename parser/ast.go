@@ -1,8 +1,6 @@
 package parser
 
 import (
-	"strconv"
-
 	"github.com/takeru56/tcompiler/token"
 )
 
@@ -12,7 +10,31 @@ import (
 
 // Node abstract Stmt and Expr
 type Node interface {
-	string() string
+	// Pos returns the location of the first token of the node
+	Pos() token.Loc
+	// End returns the location of the last token of the node
+	End() token.Loc
+	node()
+}
+
+// Span returns the location covering n from its first to its last token
+func Span(n Node) token.Loc {
+	pos, end := n.Pos(), n.End()
+	if pos.File == nil {
+		return pos
+	}
+	return pos.File.Loc(pos.Start, end.End)
+}
+
+// span returns the location from start to end. 位置のないほうは無視する
+func span(start token.Loc, end token.Loc) token.Loc {
+	if start.File == nil {
+		return end
+	}
+	if end.File == nil {
+		return start
+	}
+	return start.File.Loc(start.Start, end.End)
 }
 
 // Expr abstructs expression
@@ -28,22 +50,56 @@ type Stmt interface {
 }
 
 // For Debugging
+func (i InfixExpr) node()               {}
+func (i IntegerLiteral) node()          {}
+func (f FloatLiteral) node()            {}
+func (i IntegerRangeLiteral) node()     {}
+func (b BoolLiteral) node()             {}
+func (i IdentExpr) node()               {}
+func (k KeywordArg) node()              {}
+func (s SplatExpr) node()               {}
+func (c CallExpr) node()                {}
+func (i InstantiationExpr) node()       {}
+func (c CallMethodExpr) node()          {}
+func (t TupleExpr) node()               {}
+func (a AssignStmt) node()              {}
+func (m MultiAssignStmt) node()         {}
+func (b BlockStmt) node()               {}
+func (i IfStmt) node()                  {}
+func (c CaseStmt) node()                {}
+func (r RaiseStmt) node()               {}
+func (b BeginStmt) node()               {}
+func (r ReturnStmt) node()              {}
+func (w WhileStmt) node()               {}
+func (l LoopStmt) node()                {}
+func (f FunctionDef) node()             {}
+func (i ImportStmt) node()              {}
+func (c ClassDef) node()                {}
 func (i InfixExpr) nodeExpr()           {}
 func (i IntegerLiteral) nodeExpr()      {}
+func (f FloatLiteral) nodeExpr()        {}
 func (i IntegerRangeLiteral) nodeExpr() {}
 func (b BoolLiteral) nodeExpr()         {}
 func (i IdentExpr) nodeExpr()           {}
 func (c CallExpr) nodeExpr()            {}
 func (i InstantiationExpr) nodeExpr()   {}
 func (c CallMethodExpr) nodeExpr()      {}
+func (t TupleExpr) nodeExpr()           {}
+func (k KeywordArg) nodeExpr()          {}
+func (s SplatExpr) nodeExpr()           {}
 func (l LoopStmt) nodeStmt()            {}
 func (a AssignStmt) nodeStmt()          {}
+func (m MultiAssignStmt) nodeStmt()     {}
 func (b BlockStmt) nodeStmt()           {}
 func (i IfStmt) nodeStmt()              {}
 func (w WhileStmt) nodeStmt()           {}
 func (f FunctionDef) nodeStmt()         {}
 func (r ReturnStmt) nodeStmt()          {}
 func (c ClassDef) nodeStmt()            {}
+func (c CaseStmt) nodeStmt()            {}
+func (r RaiseStmt) nodeStmt()           {}
+func (b BeginStmt) nodeStmt()           {}
+func (i ImportStmt) nodeStmt()          {}
 
 //
 // Expr
@@ -61,8 +117,54 @@ const (
 	NEQ
 	Less
 	Greater
+	Mod
+	BitAnd
+	BitOr
+	BitXor
+	Shl
+	Shr
 )
 
+var opKindDefinition = map[OpKind]string{
+	Add:     "+",
+	Sub:     "-",
+	Mul:     "*",
+	Div:     "/",
+	EQ:      "==",
+	NEQ:     "!=",
+	Less:    "<",
+	Greater: ">",
+	Mod:     "%",
+	BitAnd:  "&",
+	BitOr:   "|",
+	BitXor:  "^",
+	Shl:     "<<",
+	Shr:     ">>",
+}
+
+func (o OpKind) String() string {
+	return opKindDefinition[o]
+}
+
+// precedence returns how tightly o binds its operands. 大きいほど強く結合する
+func (o OpKind) precedence() int {
+	switch o {
+	case EQ, NEQ:
+		return 1
+	case Less, Greater:
+		return 2
+	case BitOr, BitXor:
+		return 3
+	case BitAnd:
+		return 4
+	case Shl, Shr:
+		return 5
+	case Add, Sub:
+		return 6
+	}
+	return 7
+}
+
 // InfixExpr has a operand and two nodes.
 type InfixExpr struct {
 	tok   token.Token
@@ -71,9 +173,8 @@ type InfixExpr struct {
 	Right Node
 }
 
-func (i InfixExpr) string() string {
-	return "(" + i.Left.string() + " " + i.tok.Literal + " " + i.Right.string() + ")"
-}
+func (i InfixExpr) Pos() token.Loc { return i.Left.Pos() }
+func (i InfixExpr) End() token.Loc { return i.Right.End() }
 
 // IntegerLiteral express unsigned number
 type IntegerLiteral struct {
@@ -81,26 +182,32 @@ type IntegerLiteral struct {
 	Val int
 }
 
-func (i IntegerLiteral) string() string {
-	return strconv.Itoa(i.Val)
+func (i IntegerLiteral) Pos() token.Loc { return i.Tok.Loc }
+func (i IntegerLiteral) End() token.Loc { return i.Tok.Loc }
+
+// FloatLiteral express a number with fraction
+type FloatLiteral struct {
+	Tok token.Token
+	Val float64
 }
 
+func (f FloatLiteral) Pos() token.Loc { return f.Tok.Loc }
+func (f FloatLiteral) End() token.Loc { return f.Tok.Loc }
+
 type IntegerRangeLiteral struct {
 	From IntegerLiteral
 	To   IntegerLiteral
 }
 
-func (i IntegerRangeLiteral) string() string {
-	return strconv.Itoa(i.From.Val) + ".." + strconv.Itoa(i.To.Val)
-}
+func (i IntegerRangeLiteral) Pos() token.Loc { return i.From.Pos() }
+func (i IntegerRangeLiteral) End() token.Loc { return i.To.End() }
 
 type BoolLiteral struct {
 	Tok token.Token
 }
 
-func (b BoolLiteral) string() string {
-	return b.Tok.Literal
-}
+func (b BoolLiteral) Pos() token.Loc { return b.Tok.Loc }
+func (b BoolLiteral) End() token.Loc { return b.Tok.Loc }
 
 // IdentKind show kind of the Identifier as enum
 type IdentKind int
@@ -112,24 +219,25 @@ const (
 
 // IdentExpr has kind and name
 type IdentExpr struct {
-	kind     IdentKind
-	Name     string
-	FSelf    bool
-	ValType  IdentValType
-	ValLimit IntegerRangeLiteral
-}
-
-func (i IdentExpr) string() string {
-	if i.FSelf {
-		if i.ValType == Exclude || i.ValType == Include {
-			return "self." + i.Name + ": {" + valTypeDefinition[i.ValType] + ": " + i.ValLimit.string() + "}"
-		}
-		if i.ValType != Any {
-			return "self." + i.Name + ": " + valTypeDefinition[i.ValType]
-		}
-		return "self." + i.Name
+	kind       IdentKind
+	Name       string
+	FSelf      bool
+	ValType    IdentValType
+	ValLimit   IntegerRangeLiteral
+	Constraint ValConstraint
+	Tok        token.Token
+	// 型注釈の最後のトークン（注釈がなければ空）
+	EndTok token.Token
+}
+
+func (i IdentExpr) Pos() token.Loc { return i.Tok.Loc }
+
+// End returns the end of the type annotation if any
+func (i IdentExpr) End() token.Loc {
+	if i.EndTok.Loc.File != nil {
+		return i.EndTok.Loc
 	}
-	return i.Name
+	return i.Tok.Loc
 }
 
 type IdentValType int
@@ -143,14 +251,22 @@ const (
 	Any
 	Include
 	Exclude
+	Constrained
 )
 
 var valTypeDefinition = map[IdentValType]string{
-	Num:     "number",
-	Bool:    "bool",
-	Nil:     "nil",
-	Include: "include",
-	Exclude: "exclude",
+	Num:         "number",
+	Bool:        "bool",
+	Nil:         "nil",
+	Range:       "range",
+	Any:         "any",
+	Include:     "include",
+	Exclude:     "exclude",
+	Constrained: "constraint",
+}
+
+func (vt IdentValType) String() string {
+	return valTypeDefinition[vt]
 }
 
 func ValTypeToInt(vt IdentValType) int {
@@ -165,43 +281,88 @@ func ValTypeToInt(vt IdentValType) int {
 		return 5
 	case Exclude:
 		return 6
+	case Constrained:
+		return 7
 	}
 	return 4
 }
 
-type CallExpr struct {
-	Ident IdentExpr
-	Args  []Node
+// ValConstraint express the values a Constrained identifier can hold.
+// Include, Exclude, In are combined with AND, and Predicate names a method returning bool
+type ValConstraint struct {
+	Include   []IntegerRangeLiteral
+	Exclude   []IntegerRangeLiteral
+	In        []IntegerLiteral
+	Predicate string
 }
 
-func (c CallExpr) string() string {
-	args := ""
-	for _, arg := range c.Args {
-		args += arg.string()
-	}
-	return c.Ident.Name + "(" + args + ")"
+func (v ValConstraint) isSingleRange(ranges []IntegerRangeLiteral) bool {
+	return len(ranges) == 1 && len(v.Include)+len(v.Exclude)+len(v.In) == 1 && v.Predicate == ""
 }
 
-type InstantiationExpr struct {
+// KeywordArg is an argument passed by name such as f(a: 1)
+type KeywordArg struct {
+	Tok  token.Token
+	Name string
+	Expr Node
+}
+
+func (k KeywordArg) Pos() token.Loc { return k.Tok.Loc }
+func (k KeywordArg) End() token.Loc { return k.Expr.End() }
+
+// SplatExpr spreads the elements of a tuple as arguments such as f(*xs)
+type SplatExpr struct {
+	Tok  token.Token
+	Expr Node
+}
+
+func (s SplatExpr) Pos() token.Loc { return s.Tok.Loc }
+func (s SplatExpr) End() token.Loc { return s.Expr.End() }
+
+type CallExpr struct {
 	Ident IdentExpr
 	Args  []Node
+	// 閉じ括弧
+	EndTok token.Token
 }
 
-func (i InstantiationExpr) string() string {
-	args := ""
-	for _, arg := range i.Args {
-		args += arg.string()
-	}
-	return i.Ident.Name + "(" + args + ")"
+func (c CallExpr) Pos() token.Loc { return c.Ident.Pos() }
+func (c CallExpr) End() token.Loc { return c.EndTok.Loc }
+
+type InstantiationExpr struct {
+	Ident  IdentExpr
+	Args   []Node
+	EndTok token.Token
 }
 
+func (i InstantiationExpr) Pos() token.Loc { return i.Ident.Pos() }
+func (i InstantiationExpr) End() token.Loc { return i.EndTok.Loc }
+
 type CallMethodExpr struct {
 	Receiver Node
 	Method   Node
 }
 
-func (c CallMethodExpr) string() string {
-	return c.Receiver.string() + "." + c.Method.string()
+func (c CallMethodExpr) Pos() token.Loc { return c.Receiver.Pos() }
+func (c CallMethodExpr) End() token.Loc { return c.Method.End() }
+
+// TupleExpr has several values, used for multiple assignment and return
+type TupleExpr struct {
+	Elems []Node
+}
+
+func (t TupleExpr) Pos() token.Loc {
+	if len(t.Elems) == 0 {
+		return token.Loc{}
+	}
+	return t.Elems[0].Pos()
+}
+
+func (t TupleExpr) End() token.Loc {
+	if len(t.Elems) == 0 {
+		return token.Loc{}
+	}
+	return t.Elems[len(t.Elems)-1].End()
 }
 
 //
@@ -213,101 +374,173 @@ type AssignStmt struct {
 	Expr  Node
 }
 
-func (a AssignStmt) string() string {
-	return a.Ident.string() + " = " + a.Expr.string()
+func (a AssignStmt) Pos() token.Loc { return a.Ident.Pos() }
+func (a AssignStmt) End() token.Loc { return a.Expr.End() }
+
+// MultiAssignStmt binds Idents to the elements of Expr.
+// ExprがTupleExprなら各要素を，それ以外なら戻り値のタプルを分解して代入する
+type MultiAssignStmt struct {
+	Idents []IdentExpr
+	Expr   Node
 }
 
+func (m MultiAssignStmt) Pos() token.Loc { return m.Idents[0].Pos() }
+func (m MultiAssignStmt) End() token.Loc { return m.Expr.End() }
+
 type BlockStmt struct {
 	Nodes []Node
 }
 
-func (b BlockStmt) string() string {
-	s := "do\n"
-	for _, stmt := range b.Nodes {
-		s += "  " + stmt.string() + "\n"
+// 空のブロックは位置を持たない
+func (b BlockStmt) Pos() token.Loc {
+	if len(b.Nodes) == 0 {
+		return token.Loc{}
 	}
-	return s + "end"
+	return b.Nodes[0].Pos()
+}
+
+func (b BlockStmt) End() token.Loc {
+	if len(b.Nodes) == 0 {
+		return token.Loc{}
+	}
+	return b.Nodes[len(b.Nodes)-1].End()
 }
 
 type IfStmt struct {
+	Tok       token.Token
 	Block     BlockStmt
 	Condition Node
+	EndTok    token.Token
 }
 
-func (i IfStmt) string() string {
-	s := "if " + i.Condition.string() + " then\n"
-	for _, node := range i.Block.Nodes {
-		s += "  " + node.string() + "\n"
-	}
-	return s + "end"
+func (i IfStmt) Pos() token.Loc { return i.Tok.Loc }
+func (i IfStmt) End() token.Loc { return i.EndTok.Loc }
+
+// CaseStmt runs the block of the first WhenClause matching Subject, or Else if none does
+type CaseStmt struct {
+	Tok     token.Token
+	Subject Node
+	Whens   []WhenClause
+	Else    *BlockStmt
+	ElseTok token.Token
+	EndTok  token.Token
 }
 
-type ReturnStmt struct {
+// WhenClause matches when Subject equals one of Patterns, or is included in a IntegerRangeLiteral pattern
+type WhenClause struct {
+	Tok      token.Token
+	Patterns []Node
+	Block    BlockStmt
+}
+
+func (c CaseStmt) Pos() token.Loc { return c.Tok.Loc }
+func (c CaseStmt) End() token.Loc { return c.EndTok.Loc }
+
+// RaiseStmt raises Expr as an error
+type RaiseStmt struct {
+	Tok  token.Token
 	Expr Node
 }
 
-func (r ReturnStmt) string() string {
-	return "return " + r.Expr.string()
+func (r RaiseStmt) Pos() token.Loc { return r.Tok.Loc }
+func (r RaiseStmt) End() token.Loc { return r.Expr.End() }
+
+// BeginStmt runs Block, Rescue when Block raises, and Ensure in any case.
+// Identは受け取ったエラーを束縛する変数（省略時はnil）
+type BeginStmt struct {
+	Tok       token.Token
+	Block     BlockStmt
+	Ident     *IdentExpr
+	Rescue    *BlockStmt
+	RescueTok token.Token
+	Ensure    *BlockStmt
+	EnsureTok token.Token
+	EndTok    token.Token
 }
 
+func (b BeginStmt) Pos() token.Loc { return b.Tok.Loc }
+func (b BeginStmt) End() token.Loc { return b.EndTok.Loc }
+
+type ReturnStmt struct {
+	Tok  token.Token
+	Expr Node
+}
+
+func (r ReturnStmt) Pos() token.Loc { return r.Tok.Loc }
+func (r ReturnStmt) End() token.Loc { return r.Expr.End() }
+
 type WhileStmt struct {
+	Tok       token.Token
 	Block     BlockStmt
 	Condition Node
+	EndTok    token.Token
 }
 
-func (w WhileStmt) string() string {
-	s := "while " + w.Condition.string() + " do\n"
-	for _, node := range w.Block.Nodes {
-		s += "  " + node.string() + "\n"
-	}
-	return s + "end"
-}
+func (w WhileStmt) Pos() token.Loc { return w.Tok.Loc }
+func (w WhileStmt) End() token.Loc { return w.EndTok.Loc }
 
 // LoopStmt has a block
 type LoopStmt struct {
 	block []Stmt
 }
 
-func (l LoopStmt) string() string {
-	s := "loop {"
-	for _, b := range l.block {
-		s += " " + b.string()
-	}
-	return s + " }"
-}
+// LoopStmt is never parsed and has no location
+func (l LoopStmt) Pos() token.Loc { return token.Loc{} }
+func (l LoopStmt) End() token.Loc { return token.Loc{} }
 
 type FunctionDef struct {
+	Tok        token.Token
 	Ident      IdentExpr
 	Block      BlockStmt
 	Args       []IdentExpr
 	FlagMethod bool
-}
-
-func (f FunctionDef) string() string {
-	s := "def " + f.Ident.Name + "("
-	for i, arg := range f.Args {
-		if i > 0 {
-			s += ", "
+	// 戻り値の型（Nameは空）。宣言がなければValTypeはAny
+	Result IdentExpr
+	// Argsと同じ長さで，既定値のない引数はnil
+	Defaults []Node
+	// 最後の引数が残りの引数をまとめて受け取る
+	Variadic bool
+	EndTok   token.Token
+}
+
+// Required returns the number of arguments without default value, not counting the rest parameter
+func (f FunctionDef) Required() int {
+	n := 0
+	for i := range f.Params() {
+		if i >= len(f.Defaults) || f.Defaults[i] == nil {
+			n++
 		}
-		s += arg.Name
 	}
-	s += ")\n"
-	for _, b := range f.Block.Nodes {
-		s += "  " + b.string() + "\n"
+	return n
+}
+
+// Params returns the fixed parameters, that is Args without the rest parameter
+func (f FunctionDef) Params() []IdentExpr {
+	if f.Variadic {
+		return f.Args[:len(f.Args)-1]
 	}
-	return s + "end\n"
+	return f.Args
+}
+
+func (f FunctionDef) Pos() token.Loc { return f.Tok.Loc }
+func (f FunctionDef) End() token.Loc { return f.EndTok.Loc }
+
+// ImportStmt imports the module at Path, relative to the importing file
+type ImportStmt struct {
+	Tok     token.Token
+	Path    string
+	PathTok token.Token
 }
 
+func (i ImportStmt) Pos() token.Loc { return i.Tok.Loc }
+func (i ImportStmt) End() token.Loc { return i.PathTok.Loc }
+
 type ClassDef struct {
+	Tok     token.Token
 	Ident   IdentExpr
 	Methods []FunctionDef
+	EndTok  token.Token
 }
 
-func (c ClassDef) string() string {
-	s := "class " + c.Ident.Name + "\n"
-	for _, m := range c.Methods {
-		s += m.string()
-	}
-	s += "end"
-	return s
-}
+func (c ClassDef) Pos() token.Loc { return c.Tok.Loc }
+func (c ClassDef) End() token.Loc { return c.EndTok.Loc }
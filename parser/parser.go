@@ -3,7 +3,10 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/takeru56/tcompiler/token"
 )
@@ -13,12 +16,37 @@ type Parser struct {
 	tokenizer *token.Tokenizer
 	curToken  token.Token
 	peekToken token.Token
+	// 直前に読み終えたトークン
+	prevToken token.Token
+	// 見つけたエラーと警告
+	diags []*ParseErr
+	// KeepTriviaのときに読んだトークン
+	tokens []token.Token
+}
+
+// Severity is the level of a diagnostic
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+)
+
+func (s Severity) String() string {
+	if s == Warning {
+		return "warning"
+	}
+	return "error"
 }
 
 type ParseErr struct {
 	Err error
 	L   token.Loc
-	p   *Parser
+	// 期待したものと見つけたもの（なければ空）
+	Msg      string
+	Severity Severity
+	// 閉じられていない構文の先頭（閉じるトークンがないエラーのみ）
+	Open token.Loc
 }
 
 // custom error
@@ -27,80 +55,63 @@ var (
 )
 
 func (pe *ParseErr) Error() string {
-	st, l := lineNum(pe.p.tokenizer.Input, pe.L.Start)
-	line := displayLine(pe.p.tokenizer.Input, pe.L.Start)
-
-	switch pe.Err {
-	case ErrSyntax:
-		return fmt.Sprintf("%d:%d: %v\n%v", l, pe.L.Start-st+1, pe.Err, line)
+	msg := pe.Err.Error()
+	if pe.Msg != "" {
+		msg += ": " + pe.Msg
 	}
-	return pe.Err.Error()
-}
-
-func lineNum(s string, pos int) (int, int) {
-	line := 1
-	start := 0
-	for i := 0; i < len(s); i++ {
-		// CF: 0x0A, CD: 0x0D
-		if s[i] == 10 || s[i] == 13 {
-			start = (i + 1)
-			line++
-		}
-
-		if i == pos {
-			break
-		}
+	if pe.Severity == Warning {
+		msg = "warning: " + pe.Msg
 	}
-	return start, line
+	return fmt.Sprintf("%v: %s\n%v", pe.L, msg, pe.L.Show())
 }
 
-func displayLine(s string, pos int) string {
-	st, _ := lineNum(s, pos)
-	line := ""
-	i := st
-	for i < len(s) {
-		// CF: 0x0A, CD: 0x0D
-		if s[i] == 10 || s[i] == 13 {
-			break
-		}
-		line += s[i : i+1]
-		i++
-	}
-	line += "\n"
-	for j := 0; j < pos-st; j++ {
-		line += " "
+// ErrorList is the syntax errors of a program in source order
+type ErrorList []*ParseErr
+
+func (el ErrorList) Error() string {
+	msgs := []string{}
+	for _, e := range el {
+		msgs = append(msgs, e.Error())
 	}
-	line += "^"
-	return line
+	return strings.Join(msgs, "\n")
 }
 
 // New initialize a Parser and returns its pointer
 func New(t *token.Tokenizer) (*Parser, error) {
 	p := &Parser{tokenizer: t}
-	err := p.nextToken()
-	if err != nil {
-		return p, err
-	}
-	err = p.nextToken()
-	if err != nil {
-		return p, err
-	}
+	p.nextToken()
+	p.nextToken()
 	return p, nil
 }
 
 // nextToken advances forward curToken in the Parser
 func (p *Parser) nextToken() error {
+	p.prevToken = p.curToken
 	p.curToken = p.peekToken
 	t, err := p.tokenizer.Next()
 	if err != nil {
-		return err
+		// 字句エラーは記録して，読み飛ばした部分のトークンから構文解析を続ける
+		pe := &ParseErr{Err: err, L: t.Loc}
+		var te *token.TokenizeErr
+		if errors.As(err, &te) {
+			pe = &ParseErr{Err: te.Err, L: te.L}
+		}
+		p.diags = append(p.diags, pe)
 	}
 	p.peekToken = t
+	if p.tokenizer.KeepTrivia {
+		p.tokens = append(p.tokens, t)
+	}
 	return nil
 }
 
+// Tokens returns the tokens read so far with their trivia, when the tokenizer keeps them
+func (p *Parser) Tokens() []token.Token {
+	return p.tokens
+}
+
 func (p *Parser) consume(s string) (bool, error) {
-	if p.curToken.Literal == s {
+	if p.curToken.Literal == s && p.curToken.Kind != token.String {
 		err := p.nextToken()
 		if err != nil {
 			return true, err
@@ -110,254 +121,695 @@ func (p *Parser) consume(s string) (bool, error) {
 	return false, nil
 }
 
+// expect consumes a token of kind, or returns an error if the current token is not of kind
+func (p *Parser) expect(kind token.Kind) error {
+	if p.curToken.Kind != kind {
+		return p.expected(kind.String())
+	}
+	return p.nextToken()
+}
+
+// expectClose consumes a token of kind closing the construct started by open
+func (p *Parser) expectClose(open token.Token, kind token.Kind) error {
+	if p.curToken.Kind != kind {
+		return p.unclosed(open, kind)
+	}
+	return p.nextToken()
+}
+
+// errorAt returns a syntax error at loc
+func (p *Parser) errorAt(loc token.Loc, msg string) *ParseErr {
+	return &ParseErr{Err: ErrSyntax, L: loc, Msg: msg}
+}
+
+// expected returns an error telling what was expected at the current token
+func (p *Parser) expected(what string) *ParseErr {
+	return p.errorAt(p.curToken.Loc, "expected "+what+", found "+describe(p.curToken))
+}
+
+// expectedKinds returns an error telling that one of kinds was expected
+func (p *Parser) expectedKinds(kinds ...token.Kind) *ParseErr {
+	return p.expected(kindList(kinds))
+}
+
+// unclosed returns an error telling that one of kinds was expected to close the construct started by open.
+// 開始位置は別の行のときだけ示す（例: expected 'end' to close 'while' started at 3:1, found end of input）
+func (p *Parser) unclosed(open token.Token, kinds ...token.Kind) *ParseErr {
+	what := kindList(kinds)
+	if p.curToken.Loc.Line != open.Loc.Line {
+		what += fmt.Sprintf(" to close %v started at %d:%d", open.Kind, open.Loc.Line, open.Loc.Col)
+	}
+	pe := p.expected(what)
+	pe.Open = open.Loc
+	return pe
+}
+
+// kindList joins the names of kinds such as "'a', 'b' or 'c'"
+func kindList(kinds []token.Kind) string {
+	names := []string{}
+	for _, kind := range kinds {
+		names = append(names, kind.String())
+	}
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// describe returns a token as shown in messages. 名前や値はその内容も示す
+func describe(tok token.Token) string {
+	switch tok.Kind {
+	case token.Identifier, token.Num, token.Float:
+		return tok.Kind.String() + " '" + tok.Literal + "'"
+	case token.String:
+		return "string \"" + tok.Literal + "\""
+	}
+	return tok.Kind.String()
+}
+
+// Diagnostics returns the errors and warnings found so far in source order
+func (p *Parser) Diagnostics() []*ParseErr {
+	diags := append([]*ParseErr{}, p.diags...)
+	sort.SliceStable(diags, func(i, j int) bool { return diags[i].L.Start < diags[j].L.Start })
+	return diags
+}
+
+// Errors returns the diagnostics of Error severity
+func (p *Parser) Errors() ErrorList {
+	errs := ErrorList{}
+	for _, d := range p.Diagnostics() {
+		if d.Severity == Error {
+			errs = append(errs, d)
+		}
+	}
+	return errs
+}
+
+// Warnings returns the diagnostics of Warning severity
+func (p *Parser) Warnings() []*ParseErr {
+	warns := []*ParseErr{}
+	for _, d := range p.Diagnostics() {
+		if d.Severity == Warning {
+			warns = append(warns, d)
+		}
+	}
+	return warns
+}
+
+// report records a diagnostic. 既にエラーのある位置のエラーは字句エラーなどの巻き添えなので捨てる
+func (p *Parser) report(pe *ParseErr) {
+	for _, d := range p.diags {
+		if d.Severity == Error && d.L.Start == pe.L.Start {
+			return
+		}
+	}
+	p.diags = append(p.diags, pe)
+}
+
+// warn records a warning at the end of the previous token, where something the parser can do without is missing
+func (p *Parser) warn(msg string) {
+	loc := p.prevToken.Loc
+	if loc.File != nil {
+		loc = loc.File.Loc(loc.End, loc.End)
+	}
+	p.report(&ParseErr{Err: ErrSyntax, L: loc, Msg: msg, Severity: Warning})
+}
+
+// skip records err and skips tokens up to the start of the next statement,
+// that is a token on a later line than the error or a keyword beginning or closing a statement
+func (p *Parser) skip(err error, start token.Token) {
+	line := start.Loc.Line
+	if pe, ok := err.(*ParseErr); ok {
+		p.report(pe)
+		if pe.L.Line > line {
+			line = pe.L.Line
+		}
+	}
+	// 1トークンも読めずに失敗したときは読み飛ばして先へ進める
+	if p.curToken.Loc.Start == start.Loc.Start && p.curToken.Kind != token.EOF {
+		p.nextToken()
+	}
+	for p.curToken.Kind != token.EOF && p.curToken.Loc.Line <= line && !isBoundary(p.curToken.Kind) {
+		p.nextToken()
+	}
+}
+
+// skipBlock skips tokens up to the "end" closing the current block, counting nested blocks
+func (p *Parser) skipBlock() {
+	depth := 0
+	for p.curToken.Kind != token.EOF {
+		switch p.curToken.Kind {
+		case token.KeyIf, token.KeyWhile, token.KeyDef, token.KeyClass, token.KeyCase, token.KeyBegin:
+			depth++
+		case token.KeyEnd:
+			if depth == 0 {
+				p.nextToken()
+				return
+			}
+			depth--
+		}
+		p.nextToken()
+	}
+}
+
+// discard skips the rest of a compound statement with a broken header, so that its body does not cause more errors
+func (p *Parser) discard(err error) (Node, error) {
+	p.skipBlock()
+	return nil, err
+}
+
+// isBoundary reports whether a token of kind begins or closes a statement
+func isBoundary(kind token.Kind) bool {
+	switch kind {
+	case token.KeyDef, token.KeyClass, token.KeyImport, token.KeyIf, token.KeyWhile, token.KeyCase,
+		token.KeyBegin, token.KeyReturn, token.KeyRaise,
+		token.KeyEnd, token.KeyWhen, token.KeyElse, token.KeyRescue, token.KeyEnsure:
+		return true
+	}
+	return false
+}
+
 // 以下LL(1)parser
 // TODO: BNFで可視化
 
+// Program parses the whole input. 構文エラーの後も文の区切りから読み直し，すべてのエラーをErrorListで返す
 func (p *Parser) Program() ([]Node, error) {
 	program := []Node{}
 	for p.curToken.Kind != token.EOF {
+		start := p.curToken
 		n, err := p.class()
 		if err != nil {
-			return nil, err
+			p.skip(err, start)
+			continue
 		}
 		program = append(program, n)
 	}
+	if errs := p.Errors(); len(errs) > 0 {
+		return program, errs
+	}
 	return program, nil
 }
 
+// class ::= "class" Identifier function* "end" | importStmt | function
 func (p *Parser) class() (Node, error) {
+	// parse import
+	if p.curToken.Kind == token.KeyImport {
+		return p.importStmt()
+	}
+	if p.curToken.Kind != token.KeyClass {
+		return p.function()
+	}
+
 	// parse classDef
-	f, err := p.consume("class")
+	tok := p.curToken
+	err := p.nextToken()
 	if err != nil {
 		return ClassDef{}, err
 	}
+	if p.curToken.Kind != token.Identifier {
+		return p.discard(p.expected("class name"))
+	}
+	ident, _ := p.newFnIdentifier().(IdentExpr)
 
-	if f {
-		ident, ok := p.newFnIdentifier().(IdentExpr)
-		if !ok {
-			return ClassDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
+	methods := []FunctionDef{}
+	for p.curToken.Kind != token.KeyEnd {
+		if p.curToken.Kind == token.EOF {
+			return ClassDef{}, p.unclosed(tok, token.KeyEnd)
 		}
-
-		methods := []FunctionDef{}
-		for {
-			f, err = p.consume("end")
-			if err != nil {
-				return ClassDef{}, err
-			}
-			if f {
-				break
-			}
-			if p.curToken.Kind == token.EOF {
-				return ClassDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-			}
-
-			node, err := p.function()
-			if err != nil {
-				return FunctionDef{}, err
-			}
-			method, ok := node.(FunctionDef)
-			if !ok {
-				return nil, ErrSyntax
-			}
-			method.FlagMethod = true
-			methods = append(methods, method)
+		start := p.curToken
+		if p.curToken.Kind != token.KeyDef {
+			p.skip(p.expectedKinds(token.KeyDef, token.KeyEnd), start)
+			continue
 		}
-
-		return ClassDef{ident, methods}, nil
+		node, err := p.function()
+		if err != nil {
+			p.skip(err, start)
+			continue
+		}
+		method := node.(FunctionDef)
+		method.FlagMethod = true
+		methods = append(methods, method)
 	}
-
-	node, err := p.function()
+	err = p.nextToken()
 	if err != nil {
 		return ClassDef{}, err
 	}
-	return node, nil
+	return ClassDef{tok, ident, methods, p.prevToken}, nil
 }
 
+// function ::= "def" Identifier "(" params? ")" (":" constraint)? stmt* "end" | stmt
 func (p *Parser) function() (Node, error) {
-	// parse functionDef
-	f, err := p.consume("def")
+	if p.curToken.Kind != token.KeyDef {
+		return p.stmt()
+	}
+	tok := p.curToken
+	err := p.nextToken()
+	if err != nil {
+		return FunctionDef{}, err
+	}
+	// ident
+	if p.curToken.Kind != token.Identifier {
+		return p.discard(p.expected("function name"))
+	}
+	ident, _ := p.newFnIdentifier().(IdentExpr)
+	// params
+	args, defaults, variadic, err := p.params()
+	if err != nil {
+		return p.discard(err)
+	}
+
+	// result type
+	result := IdentExpr{ValType: Any}
+	f, err := p.consume(":")
 	if err != nil {
 		return FunctionDef{}, err
 	}
 	if f {
-		// ident
-		ident, ok := p.newFnIdentifier().(IdentExpr)
-		if !ok {
-			return FunctionDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-		}
-		// params
-		_, err := p.consume("(")
+		result, err = p.valConstraint(result)
 		if err != nil {
-			return FunctionDef{}, err
+			return p.discard(err)
 		}
+	}
 
-		args := []IdentExpr{}
-		for {
-			if p.curToken.Kind == token.EOF {
-				return FunctionDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
+	// block
+	block, err := p.blockUntil(tok, token.KeyEnd)
+	if err != nil {
+		return FunctionDef{}, err
+	}
+	err = p.nextToken()
+	if err != nil {
+		return FunctionDef{}, err
+	}
+	return FunctionDef{tok, ident, block, args, false, result, defaults, variadic, p.prevToken}, nil
+}
+
+// params ::= "(" (param ("," param)* ("," "*" Identifier)?)? ")"
+// param ::= Identifier (":" constraint)? ("=" literal)?
+func (p *Parser) params() ([]IdentExpr, []Node, bool, error) {
+	args := []IdentExpr{}
+	defaults := []Node{}
+	variadic := false
+	open := p.curToken
+	err := p.expect(token.LParen)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for {
+		f, err := p.consume(")")
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if f {
+			return args, defaults, variadic, nil
+		}
+		if len(args) > 0 {
+			if variadic {
+				return nil, nil, false, p.unclosed(open, token.RParen)
 			}
-			f, err = p.consume(")")
+			f, err = p.consume(",")
 			if err != nil {
-				return FunctionDef{}, err
+				return nil, nil, false, err
 			}
-			if f {
-				break
+			if !f {
+				return nil, nil, false, p.unclosed(open, token.Comma, token.RParen)
 			}
-			if len(args) > 0 {
-				f, err = p.consume(",")
-				if err != nil {
-					return FunctionDef{}, err
-				}
+		}
+		// rest parameter
+		if p.curToken.Kind == token.Asterisk {
+			err = p.nextToken()
+			if err != nil {
+				return nil, nil, false, err
 			}
-			arg, ok := p.newFnIdentifier().(IdentExpr)
-			if !ok {
-				return FunctionDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
+			if p.curToken.Kind != token.Identifier {
+				return nil, nil, false, p.expected("parameter name")
 			}
+			arg, _ := p.newFnIdentifier().(IdentExpr)
 			args = append(args, arg)
+			defaults = append(defaults, nil)
+			variadic = true
+			continue
 		}
-
-		// block
-		block := BlockStmt{Nodes: []Node{}}
-		for {
-			f, err = p.consume("end")
+		if p.curToken.Kind != token.Identifier {
+			return nil, nil, false, p.expected("parameter name")
+		}
+		arg, _ := p.newFnIdentifier().(IdentExpr)
+		// argument checker
+		f, err = p.consume(":")
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if f {
+			arg, err = p.valConstraint(arg)
 			if err != nil {
-				return FunctionDef{}, err
+				return nil, nil, false, err
 			}
-			if f {
-				break
-			}
-			if p.curToken.Kind == token.EOF {
-				return FunctionDef{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-			}
-
-			n, err := p.stmt()
+		}
+		// default value
+		var def Node
+		f, err = p.consume("=")
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if f {
+			def, err = p.expr()
 			if err != nil {
-				return FunctionDef{}, err
+				return nil, nil, false, err
+			}
+			// 呼び出し側で補うので既定値はリテラルに限る
+			if !isLiteral(def) {
+				return nil, nil, false, p.errorAt(def.Pos(), "default value must be a literal")
 			}
-			block.Nodes = append(block.Nodes, n)
+		} else if len(defaults) > 0 && defaults[len(defaults)-1] != nil {
+			// 既定値のある引数の後に必須の引数は置けない
+			return nil, nil, false, p.errorAt(arg.Pos(), "parameter without default value follows one with default value")
 		}
-		return FunctionDef{ident, block, args, false}, nil
+		args = append(args, arg)
+		defaults = append(defaults, def)
 	}
-	node, err := p.stmt()
-	if err != nil {
-		return FunctionDef{}, err
-	}
-	return node, nil
 }
 
 func (p *Parser) stmt() (Node, error) {
-	f, err := p.consume("if")
-	if err != nil {
-		return IfStmt{}, err
-	}
-	if f {
-		block := BlockStmt{Nodes: []Node{}}
+	tok := p.curToken
+	switch tok.Kind {
+	case token.KeyCase:
+		return p.caseStmt()
+	case token.KeyBegin:
+		return p.beginStmt()
+	case token.KeyIf, token.KeyWhile:
+		err := p.nextToken()
+		if err != nil {
+			return nil, err
+		}
 		node, err := p.expr()
+		if err != nil {
+			return p.discard(err)
+		}
+		// doの省略は警告にとどめる
+		f, err := p.consume("do")
+		if err != nil {
+			return nil, err
+		}
+		if !f {
+			p.warn("expected 'do' after the condition")
+		}
+		block, err := p.blockUntil(tok, token.KeyEnd)
+		if err != nil {
+			return nil, err
+		}
+		err = p.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		if tok.Kind == token.KeyWhile {
+			return WhileStmt{Tok: tok, Condition: node, Block: block, EndTok: p.prevToken}, nil
+		}
+		return IfStmt{Tok: tok, Condition: node, Block: block, EndTok: p.prevToken}, nil
+	case token.KeyReturn:
+		err := p.nextToken()
+		if err != nil {
+			return ReturnStmt{}, err
+		}
+		node, err := p.exprList()
 		if err != nil {
 			return node, err
 		}
-
-		f, err = p.consume("do")
+		return ReturnStmt{tok, node}, nil
+	case token.KeyRaise:
+		err := p.nextToken()
 		if err != nil {
-			return IfStmt{}, err
+			return RaiseStmt{}, err
 		}
+		node, err := p.expr()
+		if err != nil {
+			return node, err
+		}
+		return RaiseStmt{tok, node}, nil
+	}
+
+	node, err := p.assign()
+	if err != nil {
+		return node, err
+	}
+	return node, nil
+}
 
+// caseStmt ::= "case" expr ("when" pattern ("," pattern)* "then" stmt*)+ ("else" stmt*)? "end"
+func (p *Parser) caseStmt() (Node, error) {
+	tok := p.curToken
+	err := p.nextToken()
+	if err != nil {
+		return CaseStmt{}, err
+	}
+	subject, err := p.expr()
+	if err != nil {
+		return p.discard(err)
+	}
+	node := CaseStmt{Tok: tok, Subject: subject}
+	for p.curToken.Kind == token.KeyWhen {
+		when := WhenClause{Tok: p.curToken}
+		err = p.nextToken()
+		if err != nil {
+			return CaseStmt{}, err
+		}
 		for {
-			f, err = p.consume("end")
+			pattern, err := p.expr()
 			if err != nil {
-				return IfStmt{}, err
+				return p.discard(err)
 			}
-			if f {
-				break
-			}
-			if p.curToken.Kind == token.EOF {
-				return IfStmt{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
+			// 比較対象はリテラルか範囲に限る
+			if !isLiteral(pattern) {
+				return p.discard(p.errorAt(pattern.Pos(), "pattern must be a literal or a range"))
 			}
-
-			n, err := p.stmt()
+			when.Patterns = append(when.Patterns, pattern)
+			f, err := p.consume(",")
 			if err != nil {
-				return IfStmt{}, err
+				return CaseStmt{}, err
+			}
+			if !f {
+				break
 			}
-			block.Nodes = append(block.Nodes, n)
 		}
-		return IfStmt{Condition: node, Block: block}, nil
+		err = p.expect(token.KeyThen)
+		if err != nil {
+			return p.discard(err)
+		}
+		when.Block, err = p.blockUntil(tok, token.KeyWhen, token.KeyElse, token.KeyEnd)
+		if err != nil {
+			return CaseStmt{}, err
+		}
+		node.Whens = append(node.Whens, when)
+	}
+	if len(node.Whens) == 0 {
+		return p.discard(p.expectedKinds(token.KeyWhen))
+	}
+	elseTok := p.curToken
+	f, err := p.consume("else")
+	if err != nil {
+		return CaseStmt{}, err
+	}
+	if f {
+		node.ElseTok = elseTok
+		block, err := p.blockUntil(tok, token.KeyWhen, token.KeyElse, token.KeyEnd)
+		if err != nil {
+			return CaseStmt{}, err
+		}
+		node.Else = &block
+	}
+	err = p.expectClose(tok, token.KeyEnd)
+	if err != nil {
+		return p.discard(err)
 	}
+	node.EndTok = p.prevToken
+	return node, nil
+}
+
+// importStmt ::= "import" String
+func (p *Parser) importStmt() (Node, error) {
+	tok := p.curToken
+	err := p.nextToken()
+	if err != nil {
+		return ImportStmt{}, err
+	}
+	if p.curToken.Kind != token.String || p.curToken.Literal == "" {
+		return ImportStmt{}, p.expected("module path")
+	}
+	node := ImportStmt{tok, p.curToken.Literal, p.curToken}
+	err = p.nextToken()
+	if err != nil {
+		return ImportStmt{}, err
+	}
+	return node, nil
+}
 
-	f, err = p.consume("while")
+// beginStmt ::= "begin" stmt* ("rescue" Identifier? stmt*)? ("ensure" stmt*)? "end"
+func (p *Parser) beginStmt() (Node, error) {
+	node := BeginStmt{Tok: p.curToken}
+	err := p.nextToken()
+	if err != nil {
+		return BeginStmt{}, err
+	}
+	node.Block, err = p.blockUntil(node.Tok, token.KeyRescue, token.KeyEnsure, token.KeyEnd)
+	if err != nil {
+		return BeginStmt{}, err
+	}
+	rescueTok := p.curToken
+	f, err := p.consume("rescue")
 	if err != nil {
-		return WhileStmt{}, err
+		return BeginStmt{}, err
 	}
 	if f {
-		block := BlockStmt{Nodes: []Node{}}
-		node, err := p.expr()
+		node.RescueTok = rescueTok
+		// rescueと同じ行にあり，代入や呼び出しが続かない識別子はエラーを受け取る変数とみなす
+		if p.curToken.Kind == token.Identifier && p.curToken.Loc.Line == p.prevToken.Loc.Line && !continuesIdent(p.peekToken.Kind) {
+			node.Ident = &IdentExpr{Name: p.curToken.Literal, ValType: Any, Tok: p.curToken}
+			err = p.nextToken()
+			if err != nil {
+				return BeginStmt{}, err
+			}
+		}
+		block, err := p.blockUntil(node.Tok, token.KeyEnsure, token.KeyEnd)
 		if err != nil {
-			return BlockStmt{}, err
+			return BeginStmt{}, err
 		}
-		_, err = p.consume("do")
+		node.Rescue = &block
+	}
+	ensureTok := p.curToken
+	f, err = p.consume("ensure")
+	if err != nil {
+		return BeginStmt{}, err
+	}
+	if f {
+		node.EnsureTok = ensureTok
+		block, err := p.blockUntil(node.Tok, token.KeyEnd)
 		if err != nil {
-			return BlockStmt{}, err
+			return BeginStmt{}, err
 		}
+		node.Ensure = &block
+	}
+	err = p.expectClose(node.Tok, token.KeyEnd)
+	if err != nil {
+		return p.discard(err)
+	}
+	node.EndTok = p.prevToken
+	return node, nil
+}
 
-		for {
-			f, err = p.consume("end")
-			if err != nil {
-				return WhileStmt{}, err
-			}
-			if f {
-				break
-			}
-			if p.curToken.Kind == token.EOF {
-				return IfStmt{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-			}
+// continuesIdent reports whether a token of kind following an identifier continues a statement
+func continuesIdent(kind token.Kind) bool {
+	switch kind {
+	case token.Assign, token.LParen, token.Dot, token.Comma, token.Colon:
+		return true
+	}
+	return false
+}
 
-			n, err := p.stmt()
-			if err != nil {
-				return WhileStmt{}, err
+// blockUntil reads statements up to one of the given keywords closing the construct started by open.
+// 文のエラーは記録して次の文から読み直す
+func (p *Parser) blockUntil(open token.Token, kinds ...token.Kind) (BlockStmt, error) {
+	block := BlockStmt{Nodes: []Node{}}
+	for {
+		for _, kind := range kinds {
+			if p.curToken.Kind == kind {
+				return block, nil
 			}
-			block.Nodes = append(block.Nodes, n)
 		}
-		return WhileStmt{Condition: node, Block: block}, nil
+		// defとclassはブロックの中に書けないので，閉じ忘れとみなして次の定義から読み直す
+		switch p.curToken.Kind {
+		case token.EOF, token.KeyDef, token.KeyClass:
+			return block, p.unclosed(open, kinds...)
+		}
+		start := p.curToken
+		n, err := p.stmt()
+		if err != nil {
+			p.skip(err, start)
+			continue
+		}
+		block.Nodes = append(block.Nodes, n)
 	}
+}
 
-	f, err = p.consume("return")
+// assign ::= Identifier ("," Identifier)* "=" exprList | expr
+func (p *Parser) assign() (Node, error) {
+	node, err := p.expr()
 	if err != nil {
-		return ReturnStmt{}, err
+		return node, err
 	}
-	if f {
-		node, err := p.expr()
+	switch node.(type) {
+	case IdentExpr:
+		if p.curToken.Kind == token.Comma {
+			return p.multiAssign(node.(IdentExpr))
+		}
+		f, err := p.consume("=")
 		if err != nil {
-			return node, err
+			return AssignStmt{}, err
 		}
-		return ReturnStmt{node}, nil
+		if f {
+			n, err := p.exprList()
+			if err != nil {
+				return AssignStmt{}, err
+			}
+			return AssignStmt{node.(IdentExpr), n}, nil
+		}
+	}
+	return node, nil
+}
+
+func (p *Parser) multiAssign(first IdentExpr) (Node, error) {
+	idents := []IdentExpr{first}
+	for {
+		f, err := p.consume(",")
+		if err != nil {
+			return MultiAssignStmt{}, err
+		}
+		if !f {
+			break
+		}
+		n, err := p.expr()
+		if err != nil {
+			return MultiAssignStmt{}, err
+		}
+		ident, ok := n.(IdentExpr)
+		if !ok {
+			return MultiAssignStmt{}, p.errorAt(n.Pos(), "only variables can be assigned")
+		}
+		idents = append(idents, ident)
+	}
+	err := p.expect(token.Assign)
+	if err != nil {
+		return MultiAssignStmt{}, err
 	}
-
-	node, err := p.assign()
+	n, err := p.exprList()
 	if err != nil {
-		return node, err
+		return MultiAssignStmt{}, err
 	}
-	return node, nil
+	return MultiAssignStmt{idents, n}, nil
 }
 
-func (p *Parser) assign() (Node, error) {
+// exprList ::= expr ("," expr)*
+// 2つ以上の式はTupleExprにまとめる
+func (p *Parser) exprList() (Node, error) {
 	node, err := p.expr()
 	if err != nil {
 		return node, err
 	}
-	switch node.(type) {
-	case IdentExpr:
-		f, err := p.consume("=")
+	if p.curToken.Kind != token.Comma {
+		return node, nil
+	}
+	elems := []Node{node}
+	for {
+		f, err := p.consume(",")
 		if err != nil {
-			return AssignStmt{}, err
+			return TupleExpr{}, err
 		}
-		if f {
-			n, err := p.expr()
-			if err != nil {
-				return AssignStmt{}, err
-			}
-			return AssignStmt{node.(IdentExpr), n}, nil
+		if !f {
+			return TupleExpr{elems}, nil
 		}
+		n, err := p.expr()
+		if err != nil {
+			return TupleExpr{}, err
+		}
+		elems = append(elems, n)
 	}
-	return node, nil
 }
 
 func (p *Parser) expr() (Node, error) {
@@ -400,7 +852,7 @@ func (p *Parser) eq() (Node, error) {
 }
 
 func (p *Parser) compare() (Node, error) {
-	node, err := p.add()
+	node, err := p.bitOr()
 	if err != nil {
 		return node, err
 	}
@@ -410,7 +862,7 @@ func (p *Parser) compare() (Node, error) {
 			if err != nil {
 				return node, err
 			}
-			n, err := p.add()
+			n, err := p.bitOr()
 			if err != nil {
 				return node, err
 			}
@@ -419,7 +871,7 @@ func (p *Parser) compare() (Node, error) {
 			if err != nil {
 				return node, err
 			}
-			n, err := p.add()
+			n, err := p.bitOr()
 			if err != nil {
 				return node, err
 			}
@@ -430,6 +882,93 @@ func (p *Parser) compare() (Node, error) {
 	}
 }
 
+// bitOr ::= bitAnd (("|" | "^") bitAnd)*
+func (p *Parser) bitOr() (Node, error) {
+	node, err := p.bitAnd()
+	if err != nil {
+		return node, err
+	}
+	for {
+		tok := p.curToken
+		if f, err := p.consume("|"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.bitAnd()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, BitOr, node, n}
+		} else if f, err := p.consume("^"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.bitAnd()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, BitXor, node, n}
+		} else {
+			return node, nil
+		}
+	}
+}
+
+// bitAnd ::= shift ("&" shift)*
+func (p *Parser) bitAnd() (Node, error) {
+	node, err := p.shift()
+	if err != nil {
+		return node, err
+	}
+	for {
+		tok := p.curToken
+		if f, err := p.consume("&"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.shift()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, BitAnd, node, n}
+		} else {
+			return node, nil
+		}
+	}
+}
+
+// shift ::= add (("<<" | ">>") add)*
+func (p *Parser) shift() (Node, error) {
+	node, err := p.add()
+	if err != nil {
+		return node, err
+	}
+	for {
+		tok := p.curToken
+		if f, err := p.consume("<<"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.add()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, Shl, node, n}
+		} else if f, err := p.consume(">>"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.add()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, Shr, node, n}
+		} else {
+			return node, nil
+		}
+	}
+}
+
 func (p *Parser) add() (Node, error) {
 	node, err := p.mul()
 	if err != nil {
@@ -486,72 +1025,118 @@ func (p *Parser) mul() (Node, error) {
 				return node, err
 			}
 			node = InfixExpr{tok, Div, node, n}
+		} else if f, err := p.consume("%"); f {
+			if err != nil {
+				return node, err
+			}
+			n, err := p.prim()
+			if err != nil {
+				return node, err
+			}
+			node = InfixExpr{tok, Mod, node, n}
 		} else {
 			return node, nil
 		}
 	}
 }
 
-// prim ::= atom |
+// prim ::= "-" prim | atom
 func (p *Parser) prim() (Node, error) {
+	// 負の整数は符号ごと読む（-2147483648のため）
+	if p.curToken.Kind == token.Minus && p.peekToken.Kind == token.Num {
+		return p.integer()
+	}
+	if p.curToken.Kind == token.Minus {
+		tok := p.curToken
+		err := p.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		node, err := p.prim()
+		if err != nil {
+			return node, err
+		}
+		// 数のリテラルは負の定数として畳み込む（範囲は両端の符号が変わるので畳み込まない）
+		switch n := node.(type) {
+		case IntegerLiteral:
+			n.Tok.Loc = span(tok.Loc, n.Tok.Loc)
+			if -n.Val > math.MaxInt32 {
+				return nil, &ParseErr{Err: token.ErrOverflow, L: n.Tok.Loc}
+			}
+			n.Val = -n.Val
+			return n, nil
+		case FloatLiteral:
+			n.Val = -n.Val
+			n.Tok.Loc = span(tok.Loc, n.Tok.Loc)
+			return n, nil
+		}
+		// 単項の-は0からの引き算とし，0には符号のトークンを持たせる
+		return InfixExpr{tok, Sub, IntegerLiteral{tok, 0}, node}, nil
+	}
 	node, err := p.atom()
 	return node, err
 }
 
-// atom ::= IntegerLiteral | Identifier
+// atom ::= IntegerLiteral | FloatLiteral | IntegerRangeLiteral | BoolLiteral | Identifier | call | "self" "." Identifier | "(" expr ")"
 func (p *Parser) atom() (Node, error) {
 	switch p.curToken.Kind {
-	case token.Num:
-		if p.peekToken.Kind == token.DotDot {
-			return p.newIntegerRangeLiteral(), nil
+	case token.LParen:
+		open := p.curToken
+		err := p.nextToken()
+		if err != nil {
+			return nil, err
+		}
+		node, err := p.expr()
+		if err != nil {
+			return node, err
+		}
+		err = p.expectClose(open, token.RParen)
+		if err != nil {
+			return nil, err
 		}
-		return p.newIntegerLiteral(), nil
+		return node, nil
+	case token.Num:
+		return p.integer()
+	case token.Float:
+		return p.newFloatLiteral()
 	case token.KeyTrue:
-		return p.newBoolLiteral(), nil
+		return p.newBoolLiteral()
 	case token.KeyFalse:
-		return p.newBoolLiteral(), nil
+		return p.newBoolLiteral()
 	case token.Identifier:
 		var n Node
 		// CallExpr
 		if p.peekToken.Kind == token.LParen {
-			literal := p.curToken.Literal
-			p.nextToken()
-			p.nextToken()
-			args := []Node{}
-			for {
-				if p.curToken.Kind == token.EOF {
-					return CallExpr{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-				}
-				f, err := p.consume(")")
-				if err != nil {
-					return CallExpr{}, err
-				}
-				if f {
-					break
-				}
-				if len(args) > 0 {
-					f, err = p.consume(",")
-					if err != nil || !f {
-						return CallExpr{}, err
-					}
-				}
-				arg, err := p.expr()
-				if err != nil {
-					return CallExpr{}, &ParseErr{ErrSyntax, p.curToken.Loc, p}
-				}
-				args = append(args, arg)
-			}
-
-			if p.curToken.Kind != token.Dot {
-				if 'A' <= literal[0] && literal[0] <= 'Z' {
-					n = InstantiationExpr{IdentExpr{variable, literal, false, Any, IntegerRangeLiteral{}}, args}
-					return n, nil
-				}
-				n = CallExpr{IdentExpr{variable, literal, false, Any, IntegerRangeLiteral{}}, args}
-				return n, nil
+			tok := p.curToken
+			err := p.nextToken()
+			if err != nil {
+				return CallExpr{}, err
+			}
+			open := p.curToken
+			err = p.nextToken()
+			if err != nil {
+				return CallExpr{}, err
+			}
+			args, err := p.args(open)
+			if err != nil {
+				return CallExpr{}, err
+			}
+			ident := IdentExpr{variable, tok.Literal, false, Any, IntegerRangeLiteral{}, ValConstraint{}, tok, token.Token{}}
+			if 'A' <= tok.Literal[0] && tok.Literal[0] <= 'Z' {
+				n = InstantiationExpr{ident, args, p.prevToken}
+			} else {
+				n = CallExpr{ident, args, p.prevToken}
 			}
 		} else {
 			n = p.newValIdentifier(false, Any, IntegerRangeLiteral{})
+			// local variable checker
+			f, err := p.consume(":")
+			if err != nil {
+				return IdentExpr{}, err
+			}
+			if f {
+				return p.valConstraint(n.(IdentExpr))
+			}
 		}
 
 		// call method
@@ -568,12 +1153,21 @@ func (p *Parser) atom() (Node, error) {
 		}
 		return n, nil
 	case token.KeySelf:
-		p.nextToken()
-		_, err := p.consume(".")
+		self := p.curToken
+		err := p.nextToken()
+		if err != nil {
+			return IdentExpr{}, err
+		}
+		err = p.expect(token.Dot)
 		if err != nil {
 			return IdentExpr{}, err
 		}
+		if p.curToken.Kind != token.Identifier {
+			return IdentExpr{}, p.expected("instance variable name")
+		}
 		n, _ := p.newValIdentifier(true, Any, IntegerRangeLiteral{}).(IdentExpr)
+		// self.xはselfから始まる
+		n.Tok.Loc = span(self.Loc, n.Tok.Loc)
 
 		f, err := p.consume(":")
 		if err != nil {
@@ -581,90 +1175,307 @@ func (p *Parser) atom() (Node, error) {
 		}
 		if f {
 			// instance val checker
-			switch p.curToken.Kind {
-			case token.KeyNumber:
-				n.ValType = Num
-				p.nextToken()
-				return n, nil
-			case token.KeyBool:
-				n.ValType = Bool
-				p.nextToken()
-				return n, nil
+			return p.valConstraint(n)
+		}
 
-			case token.Lbrace:
-				p.nextToken()
-				if p.curToken.Kind == token.KeyInclude {
-					p.nextToken()
-					// デモ用に動作固定
-					// TODO: fix
-					_, err := p.consume(":")
-					if err != nil {
-						return IdentExpr{}, err
-					}
-					lim, _ := p.newIntegerRangeLiteral().(IntegerRangeLiteral)
-					_, err = p.consume("}")
-					if err != nil {
-						return IdentExpr{}, err
-					}
-					n.ValLimit = lim
-					n.ValType = Include
-					return n, nil
-				}
-				if p.curToken.Kind == token.KeyExclude {
-					p.nextToken()
-					_, err = p.consume(":")
-					if err != nil {
-						return IdentExpr{}, err
-					}
-					lim, _ := p.newIntegerRangeLiteral().(IntegerRangeLiteral)
-					_, err = p.consume("}")
-					if err != nil {
-						return IdentExpr{}, err
-					}
-					n.ValLimit = lim
-					n.ValType = Exclude
-					return n, nil
-				}
+		return n, nil
+	}
+	return IdentExpr{}, p.expected("expression")
+}
+
+// args ::= (arg ("," arg)*)? ")"
+// arg ::= expr | "*" expr | Identifier ":" expr
+func (p *Parser) args(open token.Token) ([]Node, error) {
+	args := []Node{}
+	for {
+		f, err := p.consume(")")
+		if err != nil {
+			return nil, err
+		}
+		if f {
+			return args, nil
+		}
+		if len(args) > 0 {
+			f, err = p.consume(",")
+			if err != nil {
+				return nil, err
+			}
+			if !f {
+				return nil, p.unclosed(open, token.Comma, token.RParen)
+			}
+		}
+		// keyword argument
+		if p.curToken.Kind == token.Identifier && p.peekToken.Kind == token.Colon {
+			name := p.curToken
+			p.nextToken()
+			err = p.nextToken()
+			if err != nil {
+				return nil, err
+			}
+			val, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, KeywordArg{name, name.Literal, val})
+			continue
+		}
+		// 位置引数はキーワード引数の前に限る
+		if len(args) > 0 {
+			if _, ok := args[len(args)-1].(KeywordArg); ok {
+				return nil, p.errorAt(p.curToken.Loc, "positional argument follows keyword argument")
+			}
+		}
+		// splat argument
+		if p.curToken.Kind == token.Asterisk {
+			star := p.curToken
+			err = p.nextToken()
+			if err != nil {
+				return nil, err
 			}
+			val, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, SplatExpr{star, val})
+			continue
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, arg)
+	}
+}
 
+// valConstraint parses the constraint following ':' and records it on the identifier
+// constraint ::= "number" | "bool" | "{" clause ("," clause)* "}"
+func (p *Parser) valConstraint(n IdentExpr) (IdentExpr, error) {
+	switch p.curToken.Kind {
+	case token.KeyNumber:
+		n.ValType = Num
+		n.EndTok = p.curToken
+		err := p.nextToken()
+		return n, err
+	case token.KeyBool:
+		n.ValType = Bool
+		n.EndTok = p.curToken
+		err := p.nextToken()
+		return n, err
+	case token.Lbrace:
+		open := p.curToken
+		err := p.nextToken()
+		if err != nil {
+			return IdentExpr{}, err
+		}
+		cons := ValConstraint{}
+		for {
+			err = p.constraintClause(&cons)
+			if err != nil {
+				return IdentExpr{}, err
+			}
+			f, err := p.consume("}")
+			if err != nil {
+				return IdentExpr{}, err
+			}
+			if f {
+				break
+			}
+			f, err = p.consume(",")
+			if err != nil {
+				return IdentExpr{}, err
+			}
+			if !f {
+				return IdentExpr{}, p.unclosed(open, token.Comma, token.Rbrace)
+			}
+		}
+		n.EndTok = p.prevToken
+		// 範囲1つだけの制約は従来どおりの形式で表現する
+		switch {
+		case cons.isSingleRange(cons.Include):
+			n.ValType = Include
+			n.ValLimit = cons.Include[0]
+		case cons.isSingleRange(cons.Exclude):
+			n.ValType = Exclude
+			n.ValLimit = cons.Exclude[0]
+		default:
+			n.ValType = Constrained
+			n.Constraint = cons
+		}
 		return n, nil
 	}
-	return p.newValIdentifier(false, Any, IntegerRangeLiteral{}), nil
+	return IdentExpr{}, p.expected("type or constraint")
 }
 
-func (p *Parser) newIntegerLiteral() Node {
-	val, _ := strconv.Atoi(p.curToken.Literal)
-	node := IntegerLiteral{p.curToken, val}
-	p.nextToken()
-	return node
+// constraintClause parses one clause of a constraint
+// clause ::= ("include" | "exclude") ":" ranges | "in" ":" "[" integers "]" | "check" ":" Identifier
+func (p *Parser) constraintClause(cons *ValConstraint) error {
+	kind := p.curToken.Kind
+	switch kind {
+	case token.KeyInclude, token.KeyExclude, token.KeyIn, token.KeyCheck:
+	default:
+		return p.expectedKinds(token.KeyInclude, token.KeyExclude, token.KeyIn, token.KeyCheck)
+	}
+	err := p.nextToken()
+	if err != nil {
+		return err
+	}
+	err = p.expect(token.Colon)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case token.KeyInclude, token.KeyExclude:
+		for {
+			if p.curToken.Kind != token.Minus && p.curToken.Kind != token.Num {
+				return p.expected("range")
+			}
+			lim, err := p.newIntegerRangeLiteral()
+			if err != nil {
+				return err
+			}
+			if kind == token.KeyInclude {
+				cons.Include = append(cons.Include, lim)
+			} else {
+				cons.Exclude = append(cons.Exclude, lim)
+			}
+			// 続く範囲があれば読む
+			if p.curToken.Kind != token.Comma || (p.peekToken.Kind != token.Num && p.peekToken.Kind != token.Minus) {
+				return nil
+			}
+			err = p.nextToken()
+			if err != nil {
+				return err
+			}
+		}
+	case token.KeyIn:
+		open := p.curToken
+		err = p.expect(token.Lbracket)
+		if err != nil {
+			return err
+		}
+		for {
+			val, err := p.newIntegerLiteral()
+			if err != nil {
+				return err
+			}
+			cons.In = append(cons.In, val)
+			f, err := p.consume("]")
+			if err != nil {
+				return err
+			}
+			if f {
+				return nil
+			}
+			f, err = p.consume(",")
+			if err != nil {
+				return err
+			}
+			if !f {
+				return p.unclosed(open, token.Comma, token.Rbracket)
+			}
+		}
+	case token.KeyCheck:
+		if p.curToken.Kind != token.Identifier {
+			return p.expected("method name")
+		}
+		if cons.Predicate != "" {
+			return p.errorAt(p.curToken.Loc, "only one 'check' is allowed")
+		}
+		cons.Predicate = p.curToken.Literal
+		return p.nextToken()
+	}
+	return nil
 }
 
-func (p *Parser) newBoolLiteral() Node {
+// isLiteral reports whether n is a constant literal
+func isLiteral(n Node) bool {
+	switch n.(type) {
+	case IntegerLiteral, FloatLiteral, BoolLiteral, IntegerRangeLiteral:
+		return true
+	}
+	return false
+}
+
+// integer ::= "-"? Num (".." "-"? Num)?
+func (p *Parser) integer() (Node, error) {
+	from, err := p.newIntegerLiteral()
+	if err != nil || p.curToken.Kind != token.DotDot {
+		return from, err
+	}
+	err = p.nextToken()
+	if err != nil {
+		return nil, err
+	}
+	to, err := p.newIntegerLiteral()
+	return IntegerRangeLiteral{From: from, To: to}, err
+}
+
+// newIntegerLiteral reads a number with an optional leading '-'
+func (p *Parser) newIntegerLiteral() (IntegerLiteral, error) {
+	sign := 1
+	minus := token.Loc{}
+	if p.curToken.Kind == token.Minus {
+		sign = -1
+		minus = p.curToken.Loc
+		err := p.nextToken()
+		if err != nil {
+			return IntegerLiteral{}, err
+		}
+	}
+	if p.curToken.Kind != token.Num {
+		return IntegerLiteral{}, p.expected("integer")
+	}
+	// 字句解析は2147483648まで通すので，符号のないものはここで弾く
+	val, err := strconv.Atoi(p.curToken.Literal)
+	if err != nil || sign*val > math.MaxInt32 {
+		return IntegerLiteral{}, &ParseErr{Err: token.ErrOverflow, L: p.curToken.Loc}
+	}
+	node := IntegerLiteral{p.curToken, sign * val}
+	node.Tok.Loc = span(minus, node.Tok.Loc)
+	return node, p.nextToken()
+}
+
+func (p *Parser) newFloatLiteral() (Node, error) {
+	// VMと同じ単精度に丸めて，定数と計算結果が等しく比較されるようにする
+	val, err := strconv.ParseFloat(p.curToken.Literal, 32)
+	if err != nil {
+		return nil, &ParseErr{Err: token.ErrOverflow, L: p.curToken.Loc}
+	}
+	node := FloatLiteral{p.curToken, float64(float32(val))}
+	return node, p.nextToken()
+}
+
+func (p *Parser) newBoolLiteral() (Node, error) {
 	node := BoolLiteral{p.curToken}
-	p.nextToken()
-	return node
+	return node, p.nextToken()
 }
 
-func (p *Parser) newIntegerRangeLiteral() Node {
-	val, _ := strconv.Atoi(p.curToken.Literal)
-	from := IntegerLiteral{p.curToken, val}
-	p.nextToken()
-	p.nextToken()
-	val, _ = strconv.Atoi(p.curToken.Literal)
-	to := IntegerLiteral{p.curToken, val}
-	p.nextToken()
-	return IntegerRangeLiteral{From: from, To: to}
+// newIntegerRangeLiteral reads two integers joined by ".."
+func (p *Parser) newIntegerRangeLiteral() (IntegerRangeLiteral, error) {
+	from, err := p.newIntegerLiteral()
+	if err != nil {
+		return IntegerRangeLiteral{}, err
+	}
+	err = p.expect(token.DotDot)
+	if err != nil {
+		return IntegerRangeLiteral{}, err
+	}
+	to, err := p.newIntegerLiteral()
+	if err != nil {
+		return IntegerRangeLiteral{}, err
+	}
+	return IntegerRangeLiteral{From: from, To: to}, nil
 }
 
 func (p *Parser) newValIdentifier(flag bool, vt IdentValType, lim IntegerRangeLiteral) Node {
-	node := IdentExpr{variable, p.curToken.Literal, flag, vt, lim}
+	node := IdentExpr{variable, p.curToken.Literal, flag, vt, lim, ValConstraint{}, p.curToken, token.Token{}}
 	p.nextToken()
 	return node
 }
 
 func (p *Parser) newFnIdentifier() Node {
-	node := IdentExpr{fn, p.curToken.Literal, false, Any, IntegerRangeLiteral{}}
+	node := IdentExpr{fn, p.curToken.Literal, false, Any, IntegerRangeLiteral{}, ValConstraint{}, p.curToken, token.Token{}}
 	p.nextToken()
 	return node
 }
@@ -1,7 +1,7 @@
 package parser
 
 import (
-	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/takeru56/tcompiler/token"
@@ -15,26 +15,40 @@ func TestParser(t *testing.T) {
 		{"1", []string{"1"}},
 		{"2..5", []string{"2..5"}},
 		{"true", []string{"true"}},
-		{"1+2*3", []string{"(1 + (2 * 3))"}},
-		{"1 * 2 + 3", []string{"((1 * 2) + 3)"}},
-		{"a=1+1", []string{"a = (1 + 1)"}},
+		{"1+2*3", []string{"1 + 2 * 3"}},
+		{"1 * 2 + 3", []string{"1 * 2 + 3"}},
+		{"(1 + 2) * 3", []string{"(1 + 2) * 3"}},
+		{"a - (b - c) - (d)", []string{"a - (b - c) - d"}},
+		{"-2..-1 - -a", []string{"-2..-1 - -a"}},
+		{"-(a + 1) * -b", []string{"-(a + 1) * -b"}},
+		{"-2147483648 - 1", []string{"-2147483648 - 1"}},
+		{"- -2147483647 + -(1..3)", []string{"2147483647 + -(1..3)"}},
+		{"3.14 * -2.0 + 1", []string{"3.14 * -2.0 + 1"}},
+		{"a | b ^ c & d << 1 + e % 2 > 3", []string{"a | b ^ c & d << 1 + e % 2 > 3"}},
+		{"(a == b) != (c < d)", []string{"a == b != c < d"}},
+		{"a == (b != c)", []string{"a == (b != c)"}},
+		{"a=1+1", []string{"a = 1 + 1"}},
+		{"a, b = b, a+1", []string{"a, b = b, a + 1"}},
+		{"q, r: number = divmod(7, 2)", []string{"q, r: number = divmod(7, 2)"}},
+		{"return q, r", []string{"return q, r"}},
+		{"p.move(1, 2).show()", []string{"p.move(1, 2).show()"}},
 		{
 			`if 3>1 do
   b = 3+5
   b+2
 end`,
-			[]string{`if (3 > 1) then
-  b = (3 + 5)
-  (b + 2)
+			[]string{`if 3 > 1 do
+  b = 3 + 5
+  b + 2
 end`}},
 		{
 			`while 3 > 1 do
   b = 3+5
   b+2
 end`,
-			[]string{`while (3 > 1) do
-  b = (3 + 5)
-  (b + 2)
+			[]string{`while 3 > 1 do
+  b = 3 + 5
+  b + 2
 end`}},
 		{
 			`def myFunc()
@@ -44,57 +58,99 @@ end`}},
 end
 myFunc()`,
 			[]string{`def myFunc()
-  b = (1 + 1)
-  (b + 2)
+  b = 1 + 1
+  b + 2
   return b
-end
-`,
+end`,
 				"myFunc()"}},
 		{
 			`
-def myFunc(a, b)
-  return a+1
+def myFunc(a)
+  return myFunc(a-2) + myFunc(a-1)
 end
-return myFunc()+1`,
-			[]string{`def myFunc(a, b)
-  return (a + 1)
+return myFunc(5)+1`,
+			[]string{`def myFunc(a)
+  return myFunc(a - 2) + myFunc(a - 1)
+end`,
+				"return myFunc(5) + 1"},
+		},
+		{
+			`
+def myFunc(a: number, b: {exclude: 1..3})
+  c: bool = true
+  return c
 end
-`,
-				"return (myFunc() + 1)"}},
+d: {include: 0..9} = myFunc(1, 5)`,
+			[]string{`def myFunc(a: number, b: {exclude: 1..3})
+  c: bool = true
+  return c
+end`,
+				"d: {include: 0..9} = myFunc(1, 5)"},
+		},
 		{
 			`
-def myFunc(a)
-  return myFunc(a-2) + myFunc(a-1)
+def area(w: number, h: number): number
+  return w*h
+end`,
+			[]string{`def area(w: number, h: number): number
+  return w * h
+end`},
+		},
+		{
+			`
+def f(a, b: number = -1, c = true)
+  return a
 end
-myFunc(5)`,
-			[]string{`def myFunc(a)
-  return (myFunc((a - 2)) + myFunc((a - 1)))
+f(1, c: false)`,
+			[]string{`def f(a, b: number = -1, c = true)
+  return a
+end`,
+				"f(1, c: false)"},
+		},
+		{
+			`
+def sum(a, *xs)
+  return a
 end
-`,
-				"myFunc(5)"},
+sum(*xs)`,
+			[]string{`def sum(a, *xs)
+  return a
+end`,
+				"sum(*xs)"},
+		},
+		{
+			"case x when 1, 2 then a = 1 when 3..5 then a = 2 else a = 3 end",
+			[]string{`case x
+when 1, 2 then
+  a = 1
+when 3..5 then
+  a = 2
+else
+  a = 3
+end`},
+		},
+		{`import "geometry" geometry.area(1)`, []string{`import "geometry"`, "geometry.area(1)"}},
+		{
+			"begin a = f() rescue e raise e ensure b = 1 end begin rescue a = 2 end raise 3",
+			[]string{`begin
+  a = f()
+rescue e
+  raise e
+ensure
+  b = 1
+end`, `begin
+rescue
+  a = 2
+end`, "raise 3"},
+		},
+		// 次の行の識別子は変数ではなく文
+		{"begin\nrescue\n  x\nend", []string{"begin\nrescue\n  x\nend"}},
+		{"begin\nrescue\n  x + 1\nend", []string{"begin\nrescue\n  x + 1\nend"}},
+		{"begin\nrescue e\n  x\nend", []string{"begin\nrescue e\n  x\nend"}},
+		{
+			"a: {include: 1..3, 5..6, exclude: 2..2, in: [1, 5], check: valid} = 1",
+			[]string{"a: {include: 1..3, 5..6, exclude: 2..2, in: [1, 5], check: valid} = 1"},
 		},
-	}
-
-	for _, c := range cases {
-		tokenizer := token.New(c.input)
-		p, _ := New(tokenizer)
-
-		i := 0
-		for p.curToken.Kind != token.EOF {
-			stmt, _ := p.class()
-			if stmt.string() != c.expected[i] {
-				fmt.Println("expecting: \n" + c.expected[i])
-				fmt.Println("but actual: \n" + stmt.string())
-				t.Error("The ast is wrong\n")
-			}
-			i++
-		}
-	}
-
-	cases2 := []struct {
-		input    string
-		expected []string
-	}{
 		{
 			`
 class LED
@@ -104,40 +160,373 @@ def on(num)
 end
 def off()
 end
-end
-a = LED()
-b = LED()
-a.on()
-b.off()`,
+end`,
 			[]string{`class LED
-def on(num)
-  self.pin: number = num
-  self.hoge: {include: 22..23} = num
+  def on(num)
+    self.pin: number = num
+    self.hoge: {include: 22..23} = num
+  end
+
+  def off()
+  end
+end`},
+		},
+	}
+
+	for _, c := range cases {
+		p, _ := New(token.New(c.input))
+		program, err := p.Program()
+		if err != nil {
+			t.Errorf("%q: %v", c.input, err)
+			continue
+		}
+		if len(program) != len(c.expected) {
+			t.Errorf("%q: expected %d statements, got %d", c.input, len(c.expected), len(program))
+			continue
+		}
+		for i, n := range program {
+			if Sprint(n) != c.expected[i] {
+				t.Errorf("expecting:\n%s\nbut actual:\n%s", c.expected[i], Sprint(n))
+			}
+		}
+	}
+}
+
+// TestFormat checks the formatted source parses to the same source
+func TestFormat(t *testing.T) {
+	input := `import "lib"
+x: {include: 0..9} = 1
+def f(a, b: number = -1, *rest): bool
+  if a == (b != -a) do
+    return true
+  end
+  return (a - 1) * -(b + 2) > 0
 end
-def off()
+class Point
+  def init(x)
+    self.x: number = x
+  end
+  def show()
+    case self.x
+    when 1, 2..3 then
+      raise 1
+    else
+      begin
+        f(self.x, b: 2)
+      rescue e
+        x = Point(1).show()
+      ensure
+        q, r = 1, 2
+      end
+    end
+  end
 end
-end`,
-				"a = LED()",
-				"b = LED()",
-				"a.on()",
-				"b.off()",
-			},
-		},
+while x < 3 do
+  x = x + 1
+end`
+	expected := `import "lib"
+x: {include: 0..9} = 1
+
+def f(a, b: number = -1, *rest): bool
+  if a == (b != -a) do
+    return true
+  end
+  return (a - 1) * -(b + 2) > 0
+end
+
+class Point
+  def init(x)
+    self.x: number = x
+  end
+
+  def show()
+    case self.x
+    when 1, 2..3 then
+      raise 1
+    else
+      begin
+        f(self.x, b: 2)
+      rescue e
+        x = Point(1).show()
+      ensure
+        q, r = 1, 2
+      end
+    end
+  end
+end
+
+while x < 3 do
+  x = x + 1
+end
+`
+	for i := 0; i < 2; i++ {
+		p, _ := New(token.New(input))
+		program, err := p.Program()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		Fprint(&b, program)
+		if b.String() != expected {
+			t.Fatalf("expecting:\n%s\nbut actual:\n%s", expected, b.String())
+		}
+		// 整形した結果をもう一度整形しても変わらない
+		input = b.String()
 	}
+}
+
+func TestFormatWithTrivia(t *testing.T) {
+	input := `# f adds one
+def f(n) # trailing
+
+
+  x = n  +1 # note
+  # before end
+end
+# top level
+y = f( 2 ) # note
+case y
+when 1 then
+  z = 1 # one
+  # other
+else # fallback
+  z = 2 # two
+end
+begin
+  z = 3 # three
+rescue e # caught
+  z = 4 # four
+ensure
+  z = 5 # five
+end
+def g()
+end
+# last`
+	expected := `# f adds one
+def f(n) # trailing
+
+  x = n + 1 # note
+  # before end
+end
 
-	for _, c := range cases2 {
-		tokenizer := token.New(c.input)
+# top level
+y = f(2) # note
+case y
+when 1 then
+  z = 1 # one
+  # other
+else # fallback
+  z = 2 # two
+end
+begin
+  z = 3 # three
+rescue e # caught
+  z = 4 # four
+ensure
+  z = 5 # five
+end
+
+def g()
+end
+# last
+`
+	for i := 0; i < 2; i++ {
+		tokenizer := token.New(input)
+		tokenizer.KeepTrivia = true
 		p, _ := New(tokenizer)
+		program, err := p.Program()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := FormatWithTrivia(program, p.Tokens())
+		if actual != expected {
+			t.Fatalf("expecting:\n%s\nbut actual:\n%s", expected, actual)
+		}
+		input = actual
+	}
+}
 
-		i := 0
-		for p.curToken.Kind != token.EOF {
-			class, _ := p.class()
-			if class.string() != c.expected[i] {
-				fmt.Println("expecting: \n" + c.expected[i])
-				fmt.Println("but actual: \n" + class.string())
-				t.Error("The ast is wrong\n")
-			}
-			i++
+// TestStmt checks every statement node is a Stmt
+func TestStmt(t *testing.T) {
+	input := `import "lib"
+x = 1
+a, b = 1, 2
+if x do end
+while x do end
+case x when 1 then end
+begin rescue e end
+raise 1
+def f() return 1 end
+class A end`
+	p, _ := New(token.New(input))
+	program, err := p.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range program {
+		if _, ok := n.(Stmt); !ok {
+			t.Errorf("%T is not a Stmt", n)
 		}
 	}
 }
+
+func TestPos(t *testing.T) {
+	cases := []struct {
+		input string
+		pos   string
+		text  string
+	}{
+		{"a + -3", "1:1", "a + -3"},
+		{"x: {include: 1..5} = f(1, k: 2)", "1:1", "x: {include: 1..5} = f(1, k: 2)"},
+		{"\n  if a do\n    b = 1\n  end", "2:3", "if a do\n    b = 1\n  end"},
+		{"while a < 3 do\nend", "1:1", "while a < 3 do\nend"},
+		{"def f(a, *b): number\n  return a, b\nend", "1:1", "def f(a, *b): number\n  return a, b\nend"},
+		{"class A\ndef init()\nself.v = 1\nend\nend", "1:1", "class A\ndef init()\nself.v = 1\nend\nend"},
+		{"case x\nwhen 1 then\n  y\nend", "1:1", "case x\nwhen 1 then\n  y\nend"},
+		{"begin\n  raise 1\nrescue e\nend", "1:1", "begin\n  raise 1\nrescue e\nend"},
+		{"import \"a\"", "1:1", "import \"a\""},
+		{"p = Point(1, 2).x", "1:1", "p = Point(1, 2).x"},
+		{"self.v: number", "1:1", "self.v: number"},
+	}
+
+	for _, c := range cases {
+		p, err := New(token.New(c.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program, err := p.Program()
+		if err != nil {
+			t.Fatalf("%q: %v", c.input, err)
+		}
+		n := program[0]
+		if n.Pos().String() != c.pos {
+			t.Errorf("%q: expected pos %s, got %s", c.input, c.pos, n.Pos())
+		}
+		loc := Span(n)
+		if text := loc.File.Text[loc.Start:loc.End]; text != c.text {
+			t.Errorf("%q: expected %q, got %q", c.input, c.text, text)
+		}
+	}
+}
+
+func TestProgramErr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"a = )\nb = 1", []string{"1:5: Syntax error: expected expression, found ')'"}},
+		{"a = 1 +\nb = (\nc = 2\nd = )", []string{
+			"2:3: Syntax error: expected expression, found '='",
+			"4:5: Syntax error: expected expression, found ')'",
+		}},
+		{"def f(a b)\n  if x do\n  end\nend\ng(1 2)", []string{
+			"1:9: Syntax error: expected ',' or ')', found identifier 'b'",
+			"5:5: Syntax error: expected ',' or ')', found integer '2'",
+		}},
+		{"while x do\n  y = \n  z = 1 1\nend", []string{
+			"3:5: Syntax error: expected expression, found '='",
+		}},
+		{"class A\n  x = 1\n  def f()\n    self.\n  end\nend", []string{
+			"2:3: Syntax error: expected 'def' or 'end', found identifier 'x'",
+			"5:3: Syntax error: expected instance variable name, found 'end'",
+		}},
+		{"if x do\n  y = 1\n", []string{"3:1: Syntax error: expected 'end' to close 'if' started at 1:1, found end of input"}},
+		{"case x\nwhen y then\n  1\nend\nz = 1 ==", []string{
+			"2:6: Syntax error: pattern must be a literal or a range",
+			"5:9: Syntax error: expected expression, found end of input",
+		}},
+		{"import x\nf(a: 1, 2)", []string{
+			"1:8: Syntax error: expected module path, found identifier 'x'",
+			"2:9: Syntax error: positional argument follows keyword argument",
+		}},
+		{"x = 1 +\ny = $ +", []string{
+			"2:3: Syntax error: expected expression, found '='",
+			"2:5: Syntax error, undefined token",
+		}},
+		// 字句エラーの後も読み続けて，すべてのエラーを報告する
+		{"x = 99999999999\ny = $ + 1\nz = \"ab\nw = 1 +", []string{
+			"1:5: Number literal overflows 32bit",
+			"2:5: Syntax error, undefined token",
+			"3:5: Syntax error, undefined token",
+			"4:8: Syntax error: expected expression, found end of input",
+		}},
+		{"x = 1\n\nwhile x < 3 do\n  if x do\n  end\n", []string{
+			"6:1: Syntax error: expected 'end' to close 'while' started at 3:1, found end of input",
+		}},
+		{"while x do\n  y = 1\n\ndef f()\n  z =\nend\nclass A\n  def g()\n    if x do\n  end\n  def h()\n  end\nend\nf()", []string{
+			"4:1: Syntax error: expected 'end' to close 'while' started at 1:1, found 'def'",
+			"6:1: Syntax error: expected expression, found 'end'",
+			"11:3: Syntax error: expected 'end' to close 'def' started at 8:3, found 'def'",
+		}},
+		{"case x\nwhen 1 then\n  y\nelse\n  z\nwhen 2 then\nend", []string{
+			"6:1: Syntax error: expected 'end' to close 'case' started at 1:1, found 'when'",
+		}},
+		{"begin\n  x\n", []string{
+			"3:1: Syntax error: expected 'rescue', 'ensure' or 'end' to close 'begin' started at 1:1, found end of input",
+		}},
+		{"f(1,\n  2\n  x = 3", []string{
+			"3:3: Syntax error: expected ',' or ')' to close '(' started at 1:2, found identifier 'x'",
+		}},
+		{"x: {incl: 1..2} = 1\ny: {in: [1 2]} = 1\nimport \"\"", []string{
+			"1:5: Syntax error: expected 'include', 'exclude', 'in' or 'check', found identifier 'incl'",
+			"2:12: Syntax error: expected ',' or ']', found integer '2'",
+			"3:8: Syntax error: expected module path, found string \"\"",
+		}},
+		{"x: {include: -3, 5} = 1\ny: {in: [-x]} = 1\nz: {include: 1..} = 1", []string{
+			"1:16: Syntax error: expected '..', found ','",
+			"2:11: Syntax error: expected integer, found identifier 'x'",
+			"3:17: Syntax error: expected integer, found '}'",
+		}},
+		{"x = 2147483648\ny = -2147483648\nz = - -2147483648", []string{
+			"1:5: Number literal overflows 32bit",
+			"3:5: Number literal overflows 32bit",
+		}},
+	}
+
+	for _, c := range cases {
+		p, err := New(token.New(c.input))
+		if err == nil {
+			_, err = p.Program()
+		}
+		errs, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("%q: expected ErrorList, got %v", c.input, err)
+			continue
+		}
+		actual := []string{}
+		for _, e := range errs {
+			actual = append(actual, strings.SplitN(e.Error(), "\n", 2)[0])
+		}
+		if strings.Join(actual, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("%q:\nexpected %q\nbut got  %q", c.input, c.expected, actual)
+		}
+	}
+}
+
+func TestUnclosed(t *testing.T) {
+	p, _ := New(token.New("def f()\n  x = 1\n"))
+	_, err := p.Program()
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", err)
+	}
+	if errs[0].Open.String() != "1:1" || errs[0].L.String() != "3:1" {
+		t.Errorf("expected the error at 3:1 opened at 1:1, got %v opened at %v", errs[0].L, errs[0].Open)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	p, _ := New(token.New("if a\n  b = 1\nend\nwhile a do\nend"))
+	_, err := p.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	warns := p.Warnings()
+	if len(warns) != 1 || warns[0].Severity != Warning {
+		t.Fatalf("expected 1 warning, got %v", warns)
+	}
+	expected := "1:5: warning: expected 'do' after the condition\nif a\n    ^"
+	if warns[0].Error() != expected {
+		t.Errorf("expected %q, got %q", expected, warns[0].Error())
+	}
+}
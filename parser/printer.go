@@ -0,0 +1,359 @@
+package parser
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/takeru56/tcompiler/token"
+)
+
+// Format returns the canonical source text of program
+func Format(program []Node) string {
+	p := &printer{}
+	p.program(program)
+	return p.buf.String()
+}
+
+// FormatWithTrivia returns the canonical source text of program, keeping the comments and blank lines attached to tokens.
+// tokensはtoken.TokenizerのKeepTriviaで読んだParser.Tokensを渡す
+func FormatWithTrivia(program []Node, tokens []token.Token) string {
+	p := &printer{}
+	for _, tok := range tokens {
+		p.trivia = append(p.trivia, tok.Leading...)
+	}
+	p.program(program)
+	p.flush(-1)
+	return p.buf.String()
+}
+
+// Fprint writes the canonical source text of program to w
+func Fprint(w io.Writer, program []Node) error {
+	_, err := io.WriteString(w, Format(program))
+	return err
+}
+
+// Sprint returns the source text of n without the last line break
+func Sprint(n Node) string {
+	p := &printer{}
+	p.stmt(n)
+	return strings.TrimSuffix(p.buf.String(), "\n")
+}
+
+// printer writes nodes as source text, indenting blocks by two spaces
+type printer struct {
+	buf    bytes.Buffer
+	indent int
+	// まだ書いていないコメントと空行
+	trivia []token.Trivia
+}
+
+// unary is the precedence of the operand of unary '-'
+const unary = 8
+
+func (p *printer) line(s string) {
+	if s != "" {
+		p.buf.WriteString(strings.Repeat("  ", p.indent))
+	}
+	p.buf.WriteString(s + "\n")
+}
+
+// blank writes an empty line, unless at the start or after another empty line
+func (p *printer) blank() {
+	b := p.buf.Bytes()
+	if len(b) == 0 || bytes.HasSuffix(b, []byte("\n\n")) {
+		return
+	}
+	p.line("")
+}
+
+// flush writes the trivia before offset, or all of them if offset is negative.
+// 行末のコメントは直前の行の後ろに付ける
+func (p *printer) flush(offset int) {
+	for len(p.trivia) > 0 && (offset < 0 || p.trivia[0].Loc.Start < offset) {
+		tr := p.trivia[0]
+		p.trivia = p.trivia[1:]
+		switch {
+		case tr.Kind == token.BlankLine:
+			p.blank()
+		case tr.Trailing && bytes.HasSuffix(p.buf.Bytes(), []byte("\n")) && !bytes.HasSuffix(p.buf.Bytes(), []byte("\n\n")):
+			p.buf.Truncate(p.buf.Len() - 1)
+			p.buf.WriteString(" " + strings.TrimRight(tr.Text, " \t") + "\n")
+		default:
+			p.line(strings.TrimRight(tr.Text, " \t"))
+		}
+	}
+}
+
+// trailing writes the comments left at the end of the last line before offset.
+// 空行を入れる前に書かないと次の定義のコメントに見えてしまう
+func (p *printer) trailing(offset int) {
+	for len(p.trivia) > 0 && p.trivia[0].Trailing && p.trivia[0].Loc.Start < offset {
+		p.flush(p.trivia[0].Loc.End)
+	}
+}
+
+// close writes the trivia before the "end" at end inside the block, then the "end"
+func (p *printer) close(end token.Loc) {
+	p.keyword(end, "end")
+}
+
+// keyword writes the trivia before the keyword at loc inside the preceding block, then the line s.
+// when，else，rescue，ensureの前のコメントもその前の行に残す
+func (p *printer) keyword(loc token.Loc, s string) {
+	if loc.File != nil {
+		p.indent++
+		p.flush(loc.Start)
+		p.indent--
+	}
+	p.line(s)
+}
+
+// program writes the top level statements. 関数とクラスの前後は1行空ける
+func (p *printer) program(nodes []Node) {
+	for i, n := range nodes {
+		if i > 0 && (isDef(n) || isDef(nodes[i-1])) {
+			p.trailing(n.Pos().Start)
+			p.blank()
+		}
+		p.stmt(n)
+	}
+}
+
+func isDef(n Node) bool {
+	switch n.(type) {
+	case FunctionDef, ClassDef:
+		return true
+	}
+	return false
+}
+
+func (p *printer) block(nodes []Node) {
+	p.indent++
+	for _, n := range nodes {
+		p.stmt(n)
+	}
+	p.indent--
+}
+
+func (p *printer) stmt(n Node) {
+	if pos := n.Pos(); pos.File != nil {
+		p.flush(pos.Start)
+	}
+	switch n := n.(type) {
+	case IfStmt:
+		p.line("if " + expr(n.Condition, 0) + " do")
+		p.block(n.Block.Nodes)
+		p.close(n.End())
+	case WhileStmt:
+		p.line("while " + expr(n.Condition, 0) + " do")
+		p.block(n.Block.Nodes)
+		p.close(n.End())
+	case LoopStmt:
+		p.line("loop do")
+		p.indent++
+		for _, s := range n.block {
+			p.stmt(s)
+		}
+		p.indent--
+		p.line("end")
+	case CaseStmt:
+		p.line("case " + expr(n.Subject, 0))
+		for _, w := range n.Whens {
+			p.keyword(w.Tok.Loc, "when "+list(w.Patterns)+" then")
+			p.block(w.Block.Nodes)
+		}
+		if n.Else != nil {
+			p.keyword(n.ElseTok.Loc, "else")
+			p.block(n.Else.Nodes)
+		}
+		p.close(n.End())
+	case BeginStmt:
+		p.line("begin")
+		p.block(n.Block.Nodes)
+		if n.Rescue != nil {
+			if n.Ident != nil {
+				p.keyword(n.RescueTok.Loc, "rescue "+n.Ident.Name)
+			} else {
+				p.keyword(n.RescueTok.Loc, "rescue")
+			}
+			p.block(n.Rescue.Nodes)
+		}
+		if n.Ensure != nil {
+			p.keyword(n.EnsureTok.Loc, "ensure")
+			p.block(n.Ensure.Nodes)
+		}
+		p.close(n.End())
+	case BlockStmt:
+		for _, s := range n.Nodes {
+			p.stmt(s)
+		}
+	case FunctionDef:
+		p.line(signature(n))
+		p.block(n.Block.Nodes)
+		p.close(n.End())
+	case ClassDef:
+		p.line("class " + n.Ident.Name)
+		p.indent++
+		for i, m := range n.Methods {
+			if i > 0 {
+				p.trailing(m.Pos().Start)
+				p.blank()
+			}
+			p.stmt(m)
+		}
+		p.indent--
+		p.close(n.End())
+	case AssignStmt:
+		p.line(ident(n.Ident) + " = " + expr(n.Expr, 0))
+	case MultiAssignStmt:
+		idents := []string{}
+		for _, i := range n.Idents {
+			idents = append(idents, ident(i))
+		}
+		p.line(strings.Join(idents, ", ") + " = " + expr(n.Expr, 0))
+	case ReturnStmt:
+		p.line("return " + expr(n.Expr, 0))
+	case RaiseStmt:
+		p.line("raise " + expr(n.Expr, 0))
+	case ImportStmt:
+		p.line("import \"" + n.Path + "\"")
+	default:
+		p.line(expr(n, 0))
+	}
+}
+
+// signature returns the first line of a function definition
+func signature(f FunctionDef) string {
+	params := []string{}
+	for i, arg := range f.Args {
+		s := ident(arg)
+		if f.Variadic && i == len(f.Args)-1 {
+			s = "*" + s
+		}
+		if i < len(f.Defaults) && f.Defaults[i] != nil {
+			s += " = " + expr(f.Defaults[i], 0)
+		}
+		params = append(params, s)
+	}
+	return "def " + f.Ident.Name + "(" + strings.Join(params, ", ") + ")" + annotation(f.Result)
+}
+
+// expr returns the source text of n, in parentheses if it binds looser than prec
+func expr(n Node, prec int) string {
+	switch n := n.(type) {
+	case InfixExpr:
+		if operand, ok := negation(n); ok {
+			// 範囲の前の-は始点の符号と読まれるので括弧で囲む
+			if _, ok := operand.(IntegerRangeLiteral); ok {
+				return "-(" + expr(operand, 0) + ")"
+			}
+			return "-" + expr(operand, unary)
+		}
+		op := n.Op.precedence()
+		// 左結合なので右辺は同じ強さでも括弧で囲む
+		s := expr(n.Left, op) + " " + n.Op.String() + " " + expr(n.Right, op+1)
+		if op < prec {
+			return "(" + s + ")"
+		}
+		return s
+	case IntegerLiteral:
+		return strconv.Itoa(n.Val)
+	case FloatLiteral:
+		s := strconv.FormatFloat(n.Val, 'f', -1, 32)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case IntegerRangeLiteral:
+		return rangeText(n)
+	case BoolLiteral:
+		return n.Tok.Literal
+	case IdentExpr:
+		return ident(n)
+	case CallExpr:
+		return n.Ident.Name + "(" + list(n.Args) + ")"
+	case InstantiationExpr:
+		return n.Ident.Name + "(" + list(n.Args) + ")"
+	case CallMethodExpr:
+		return expr(n.Receiver, unary) + "." + expr(n.Method, unary)
+	case TupleExpr:
+		return list(n.Elems)
+	case KeywordArg:
+		return n.Name + ": " + expr(n.Expr, 0)
+	case SplatExpr:
+		return "*" + expr(n.Expr, unary)
+	}
+	return ""
+}
+
+// negation returns the operand if n is a unary '-', which the parser reads as 0 - operand
+func negation(n InfixExpr) (Node, bool) {
+	zero, ok := n.Left.(IntegerLiteral)
+	if n.Op == Sub && ok && zero.Val == 0 && zero.Tok.Kind == token.Minus {
+		return n.Right, true
+	}
+	return nil, false
+}
+
+func list(nodes []Node) string {
+	s := []string{}
+	for _, n := range nodes {
+		s = append(s, expr(n, 0))
+	}
+	return strings.Join(s, ", ")
+}
+
+func rangeText(r IntegerRangeLiteral) string {
+	return strconv.Itoa(r.From.Val) + ".." + strconv.Itoa(r.To.Val)
+}
+
+// ident returns an identifier with its type annotation
+func ident(i IdentExpr) string {
+	s := i.Name
+	if i.FSelf {
+		s = "self." + s
+	}
+	return s + annotation(i)
+}
+
+// annotation returns the type annotation of i such as ": number", or "" if it has none
+func annotation(i IdentExpr) string {
+	switch i.ValType {
+	case Num, Bool:
+		return ": " + i.ValType.String()
+	case Include, Exclude:
+		return ": {" + i.ValType.String() + ": " + rangeText(i.ValLimit) + "}"
+	case Constrained:
+		return ": " + constraint(i.Constraint)
+	}
+	return ""
+}
+
+func constraint(v ValConstraint) string {
+	clauses := []string{}
+	ranges := func(key string, rs []IntegerRangeLiteral) {
+		if len(rs) == 0 {
+			return
+		}
+		s := []string{}
+		for _, r := range rs {
+			s = append(s, rangeText(r))
+		}
+		clauses = append(clauses, key+": "+strings.Join(s, ", "))
+	}
+	ranges("include", v.Include)
+	ranges("exclude", v.Exclude)
+	if len(v.In) > 0 {
+		s := []string{}
+		for _, val := range v.In {
+			s = append(s, strconv.Itoa(val.Val))
+		}
+		clauses = append(clauses, "in: ["+strings.Join(s, ", ")+"]")
+	}
+	if v.Predicate != "" {
+		clauses = append(clauses, "check: "+v.Predicate)
+	}
+	return "{" + strings.Join(clauses, ", ") + "}"
+}
@@ -0,0 +1,99 @@
+package token
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// File is a source file with the positions where its lines start
+type File struct {
+	Name string
+	Text string
+	// 各行の先頭のbyte位置
+	lines []int
+}
+
+// NewFile returns a File of text. 改行は\n, \r\n, \rのいずれも1つと数える
+func NewFile(name string, text string) *File {
+	lines := []int{0}
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				i++
+			}
+			lines = append(lines, i+1)
+		case '\n':
+			lines = append(lines, i+1)
+		}
+	}
+	return &File{Name: name, Text: text, lines: lines}
+}
+
+// Position returns the line and the column of the byte at offset.
+// どちらも1から数え，列はUTF-8の文字単位
+func (f *File) Position(offset int) (int, int) {
+	if offset > len(f.Text) {
+		offset = len(f.Text)
+	}
+	i := sort.SearchInts(f.lines, offset+1) - 1
+	return i + 1, utf8.RuneCountInString(f.Text[f.lines[i]:offset]) + 1
+}
+
+// Line returns the text of the nth line without its line break
+func (f *File) Line(n int) string {
+	if n < 1 || n > len(f.lines) {
+		return ""
+	}
+	end := len(f.Text)
+	if n < len(f.lines) {
+		end = f.lines[n]
+	}
+	return strings.TrimRight(f.Text[f.lines[n-1]:end], "\r\n")
+}
+
+// Loc returns the location of the bytes from start to end
+func (f *File) Loc(start int, end int) Loc {
+	line, col := f.Position(start)
+	return Loc{Start: start, End: end, Line: line, Col: col, File: f}
+}
+
+// Loc express Line of code for token
+type Loc struct {
+	Start int
+	End   int
+	// Startの行と列（1から）
+	Line int
+	Col  int
+	File *File
+}
+
+func (l Loc) String() string {
+	if l.File == nil || l.File.Name == "" {
+		return fmt.Sprintf("%d:%d", l.Line, l.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", l.File.Name, l.Line, l.Col)
+}
+
+// Show returns the line of l with a caret under its start
+func (l Loc) Show() string {
+	if l.File == nil {
+		return ""
+	}
+	text := l.File.Line(l.Line)
+	caret := ""
+	// タブはそのまま残して桁を揃える
+	for i, r := range []rune(text) {
+		if i >= l.Col-1 {
+			break
+		}
+		if r == '\t' {
+			caret += "\t"
+		} else {
+			caret += " "
+		}
+	}
+	return text + "\n" + caret + "^"
+}
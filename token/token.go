@@ -3,82 +3,49 @@ package token
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Tokenizer has source code and read position
 type Tokenizer struct {
 	Input string
 	Pos   int
+	File  *File
+	// trueならコメントと空行をTriviaとして次のトークンに付ける
+	KeepTrivia bool
 }
 
 type TokenizeErr struct {
 	Err error
 	L   Loc
-	t   *Tokenizer
 }
 
 // custom error
 var (
 	ErrSyntax   = errors.New("Syntax error, undefined token")
 	ErrConstant = errors.New("constant not support")
+	ErrOverflow = errors.New("Number literal overflows 32bit")
 )
 
 func (te *TokenizeErr) Error() string {
-	st, l := lineNum(te.t.Input, te.L.Start)
-	line := displayLine(te.t.Input, te.L.Start)
-
 	switch te.Err {
-	case ErrSyntax:
-		return fmt.Sprintf("%d:%d: %v\n%v", l, te.L.Start-st+1, te.Err, line)
-	case ErrConstant:
-		return fmt.Sprintf("%d:%d: %v\n%v", l, te.L.Start-st+1, te.Err, line)
+	case ErrSyntax, ErrConstant, ErrOverflow:
+		return fmt.Sprintf("%v: %v\n%v", te.L, te.Err, te.L.Show())
 	}
 	return te.Err.Error()
 }
 
-// posは，s中のstart番目から始まるline行目の文字
-func lineNum(s string, pos int) (int, int) {
-	line := 1
-	start := 0
-	for i := 0; i < len(s); i++ {
-		// CF: 0x0A, CD: 0x0D
-		if s[i] == 10 || s[i] == 13 {
-			start = (i + 1)
-			line++
-		}
-
-		if i == pos {
-			break
-		}
-	}
-	return start, line
-}
-
-func displayLine(s string, pos int) string {
-	st, _ := lineNum(s, pos)
-	line := ""
-	i := st
-	for i < len(s) {
-		// CF: 0x0A, CD: 0x0D
-		if s[i] == 10 || s[i] == 13 {
-			break
-		}
-		line += s[i : i+1]
-		i++
-	}
-	line += "\n"
-	for j := 0; j < pos-st; j++ {
-		line += " "
-	}
-	line += "^"
-	return line
-}
-
 // New initialize a Tokenizer and returns its pointer
 func New(input string) *Tokenizer {
-	return &Tokenizer{input, 0}
+	return FromFile(NewFile("", input))
+}
+
+// FromFile initialize a Tokenizer reading f
+func FromFile(f *File) *Tokenizer {
+	return &Tokenizer{Input: f.Text, Pos: 0, File: f}
 }
 
 func (t *Tokenizer) recognizeMany(f func(byte) bool) {
@@ -102,55 +69,62 @@ func isAlnum(b byte) bool {
 func (t *Tokenizer) lexNumber() Token {
 	start := t.Pos
 	t.recognizeMany(isDigit)
-	return Token{Num, t.Input[start:t.Pos], Loc{start, t.Pos}}
+	// 小数点の後に数字が続くときだけ小数とみなす（1..3 は範囲）
+	if t.Pos+1 < len(t.Input) && t.Input[t.Pos] == '.' && isDigit(t.Input[t.Pos+1]) {
+		t.Pos++
+		t.recognizeMany(isDigit)
+		return Token{Kind: Float, Literal: t.Input[start:t.Pos], Loc: Loc{Start: start, End: t.Pos}}
+	}
+	return Token{Kind: Num, Literal: t.Input[start:t.Pos], Loc: Loc{Start: start, End: t.Pos}}
 }
 
 func (t *Tokenizer) lexIdent() Token {
 	start := t.Pos
 	t.recognizeMany(isAlnum)
-	return Token{Identifier, t.Input[start:t.Pos], Loc{start, t.Pos}}
+	return Token{Kind: Identifier, Literal: t.Input[start:t.Pos], Loc: Loc{Start: start, End: t.Pos}}
+}
+
+// lexString reads a double quoted string. Literalは引用符を含まない
+func (t *Tokenizer) lexString() (Token, error) {
+	start := t.Pos
+	end := strings.IndexAny(t.Input[start+1:], "\"\r\n")
+	if end < 0 || t.Input[start+1+end] != '"' {
+		t.skipLine()
+		return Token{Kind: Illegal, Literal: t.Input[start:t.Pos], Loc: Loc{Start: start, End: t.Pos}}, &TokenizeErr{ErrSyntax, t.File.Loc(start, start)}
+	}
+	t.Pos = start + 1 + end + 1
+	return Token{Kind: String, Literal: t.Input[start+1 : start+1+end], Loc: Loc{Start: start, End: t.Pos}}, nil
 }
 
 func (t *Tokenizer) lexSpaces() {
-	t.recognizeMany(func(b byte) bool { return (strings.IndexByte(" \n\t", b) > -1) })
+	t.recognizeMany(isSpace)
+}
+
+func isSpace(b byte) bool {
+	return strings.IndexByte(" \n\r\t", b) > -1
 }
 
 func (t *Tokenizer) skipLine() {
-	t.recognizeMany(func(b byte) bool { return (b != '\n') })
+	t.recognizeMany(func(b byte) bool { return (b != '\n' && b != '\r') })
 }
 
-// Next returns a Token and move forward current position
+// Next returns a Token and move forward current position.
+// 字句エラーのときも読み飛ばした部分をトークンとして返すので，続きを読める
 func (t *Tokenizer) Next() (Token, error) {
-	// TODO: Refactoring from LL:51 to LL:62
-	if t.Pos >= len(t.Input) {
-		return t.newToken(EOF, ""), nil
-	}
-	ch := t.Input[t.Pos]
-
-	if ch == ' ' || ch == '\t' || ch == '\n' {
-		t.lexSpaces()
-	}
-	if t.Pos >= len(t.Input) {
-		return t.newToken(EOF, ""), nil
-	}
-	ch = t.Input[t.Pos]
-
-	if ch == '#' {
-		t.skipLine()
-	}
-
-	if t.Pos >= len(t.Input) {
-		return t.newToken(EOF, ""), nil
+	trivia := t.skipTrivia()
+	tok, err := t.next()
+	tok.Loc = t.File.Loc(tok.Loc.Start, tok.Loc.End)
+	if t.KeepTrivia {
+		tok.Leading = trivia
 	}
-	ch = t.Input[t.Pos]
+	return tok, err
+}
 
-	if ch == ' ' || ch == '\t' || ch == '\n' {
-		t.lexSpaces()
-	}
+func (t *Tokenizer) next() (Token, error) {
 	if t.Pos >= len(t.Input) {
 		return t.newToken(EOF, ""), nil
 	}
-	ch = t.Input[t.Pos]
+	ch := t.Input[t.Pos]
 
 	switch {
 	case ch == '+':
@@ -161,6 +135,16 @@ func (t *Tokenizer) Next() (Token, error) {
 		return t.newToken(Asterisk, string(ch)), nil
 	case ch == '/':
 		return t.newToken(Slash, string(ch)), nil
+	case ch == '%':
+		return t.newToken(Percent, string(ch)), nil
+	case ch == '&':
+		return t.newToken(Ampersand, string(ch)), nil
+	case ch == '|':
+		return t.newToken(Pipe, string(ch)), nil
+	case ch == '^':
+		return t.newToken(Caret, string(ch)), nil
+	case ch == '"':
+		return t.lexString()
 	case ch == '[':
 		return t.newToken(Lbracket, string(ch)), nil
 	case ch == ']':
@@ -192,31 +176,44 @@ func (t *Tokenizer) Next() (Token, error) {
 			return t.newToken(NEq, "!="), nil
 		}
 	case ch == '<':
+		if strings.HasPrefix(t.Input[t.Pos:], "<<") {
+			return t.newToken(LShift, "<<"), nil
+		}
 		return t.newToken(LessThan, string(ch)), nil
 	case ch == '>':
+		if strings.HasPrefix(t.Input[t.Pos:], ">>") {
+			return t.newToken(RShift, ">>"), nil
+		}
 		return t.newToken(GreaterThan, string(ch)), nil
 	case isDigit(ch):
 		head := t.Pos
 		tk := t.lexNumber()
+		if tk.Kind == Float {
+			_, err := strconv.ParseFloat(tk.Literal, 32)
+			if err != nil {
+				return tk, &TokenizeErr{ErrOverflow, t.File.Loc(head, t.Pos)}
+			}
+			return tk, nil
+		}
+		// -2147483648のために1つ大きい値まで読む
 		val, err := strconv.Atoi(tk.Literal)
-		if err != nil || val < 0 || val >= 65536 {
-			return Token{}, &TokenizeErr{ErrConstant, Loc{head, t.Pos}, t}
+		if err != nil || val > math.MaxInt32+1 {
+			return tk, &TokenizeErr{ErrOverflow, t.File.Loc(head, t.Pos)}
 		}
 		return tk, nil
 	case t.isReserved():
 		for _, v := range reserved {
-			blank := len(t.Input) - t.Pos
-			if blank < len(v) {
-				continue
-			}
-			if t.Input[t.Pos:t.Pos+len(v)] == v {
+			if t.matchReserved(v) {
 				return t.newToken(reservedToKind[v], t.Input[t.Pos:t.Pos+len(v)]), nil
 			}
 		}
 	case isChar(ch):
 		return t.lexIdent(), nil
 	}
-	return Token{}, &TokenizeErr{ErrSyntax, Loc{t.Pos, t.Pos}, t}
+	// 後ろの入力も読めるように，分からない文字は1文字だけ読み飛ばす
+	loc := t.File.Loc(t.Pos, t.Pos)
+	_, size := utf8.DecodeRuneInString(t.Input[t.Pos:])
+	return t.newToken(Illegal, t.Input[t.Pos:t.Pos+size]), &TokenizeErr{ErrSyntax, loc}
 }
 
 // Kind express the token kind as enum
@@ -264,8 +261,75 @@ const (
 	DotDot                  // 36: ..
 	KeyInclude              // 37
 	KeyExclude              // 38
+	KeyIn                   // 39
+	KeyCheck                // 40
+	Float                   // 41: 3.14
+	Percent                 // 42: %
+	Ampersand               // 43: &
+	Pipe                    // 44: |
+	Caret                   // 45: ^
+	LShift                  // 46: <<
+	RShift                  // 47: >>
+	KeyCase                 // 48
+	KeyWhen                 // 49
+	KeyElse                 // 50
+	KeyRaise                // 51
+	KeyBegin                // 52
+	KeyRescue               // 53
+	KeyEnsure               // 54
+	String                  // 55: "geometry"
+	KeyImport               // 56
+	Illegal                 // 57: 字句エラーになった部分
 )
 
+var kindNames = map[Kind]string{
+	Num:         "integer",
+	Plus:        "'+'",
+	Minus:       "'-'",
+	Asterisk:    "'*'",
+	Slash:       "'/'",
+	Lbracket:    "'['",
+	Rbracket:    "']'",
+	LParen:      "'('",
+	RParen:      "')'",
+	Assign:      "'='",
+	Comma:       "','",
+	Lbrace:      "'{'",
+	Rbrace:      "'}'",
+	Eq:          "'=='",
+	NEq:         "'!='",
+	LessThan:    "'<'",
+	GreaterThan: "'>'",
+	Identifier:  "identifier",
+	EOF:         "end of input",
+	Dot:         "'.'",
+	Number:      "'#'",
+	Colon:       "':'",
+	DotDot:      "'..'",
+	Float:       "float",
+	Percent:     "'%'",
+	Ampersand:   "'&'",
+	Pipe:        "'|'",
+	Caret:       "'^'",
+	LShift:      "'<<'",
+	RShift:      "'>>'",
+	String:      "string",
+	Illegal:     "illegal token",
+}
+
+// String returns the name of k used in messages. 記号とキーワードは引用符で囲む
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	for word, kind := range reservedToKind {
+		if kind == k {
+			return "'" + word + "'"
+		}
+	}
+	return "unknown"
+}
+
 var reserved = []string{
 	"loop",
 	"if",
@@ -284,6 +348,16 @@ var reserved = []string{
 	"false",
 	"include",
 	"exclude",
+	"in",
+	"check",
+	"case",
+	"when",
+	"else",
+	"raise",
+	"begin",
+	"rescue",
+	"ensure",
+	"import",
 }
 
 var reservedToKind = map[string]Kind{
@@ -304,36 +378,51 @@ var reservedToKind = map[string]Kind{
 	"false":   KeyFalse,
 	"include": KeyInclude,
 	"exclude": KeyExclude,
+	"in":      KeyIn,
+	"check":   KeyCheck,
+	"case":    KeyCase,
+	"when":    KeyWhen,
+	"else":    KeyElse,
+	"raise":   KeyRaise,
+	"begin":   KeyBegin,
+	"rescue":  KeyRescue,
+	"ensure":  KeyEnsure,
+	"import":  KeyImport,
 }
 
 func (t Tokenizer) isReserved() bool {
 	for _, v := range reserved {
-		blank := len(t.Input) - t.Pos
-		if blank < len(v) {
-			continue
-		}
-		if t.Input[t.Pos:t.Pos+len(v)] == v {
+		if t.matchReserved(v) {
 			return true
 		}
 	}
 	return false
 }
 
+// matchReserved reports whether the reserved word v starts at the current position.
+// 識別子の途中で切れないように（例: init, index）直後が英数字でないことを確認する
+func (t Tokenizer) matchReserved(v string) bool {
+	blank := len(t.Input) - t.Pos
+	if blank < len(v) {
+		return false
+	}
+	if t.Input[t.Pos:t.Pos+len(v)] != v {
+		return false
+	}
+	return blank == len(v) || !isAlnum(t.Input[t.Pos+len(v)])
+}
+
 // Token consits of its kind and literal
 type Token struct {
 	Kind    Kind
 	Literal string
 	Loc     Loc
-}
-
-// Loc express Line of code for token
-type Loc struct {
-	Start int
-	End   int
+	// 直前のコメントと空行（KeepTriviaのときのみ）
+	Leading []Trivia
 }
 
 func (t *Tokenizer) newToken(tk Kind, lit string) Token {
 	start := t.Pos
 	t.Pos += len(lit)
-	return Token{tk, lit, Loc{start, t.Pos}}
+	return Token{Kind: tk, Literal: lit, Loc: Loc{Start: start, End: t.Pos}}
 }
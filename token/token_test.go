@@ -233,4 +233,214 @@ a.on(3) # call on method`
 			t.Error("The token literal is wrong\n")
 		}
 	}
+
+	input5 := "in init index check checked do done case when else elsewhere raise begin rescue ensure import \"lib/geometry\""
+	case5 := []struct {
+		expectKind    Kind
+		expectLiteral string
+	}{
+		{KeyIn, "in"},
+		{Identifier, "init"},
+		{Identifier, "index"},
+		{KeyCheck, "check"},
+		{Identifier, "checked"},
+		{KeyDo, "do"},
+		{Identifier, "done"},
+		{KeyCase, "case"},
+		{KeyWhen, "when"},
+		{KeyElse, "else"},
+		{Identifier, "elsewhere"},
+		{KeyRaise, "raise"},
+		{KeyBegin, "begin"},
+		{KeyRescue, "rescue"},
+		{KeyEnsure, "ensure"},
+		{KeyImport, "import"},
+		{String, "lib/geometry"},
+		{EOF, ""},
+	}
+	tokenizer = New(input5)
+	for _, c := range case5 {
+		token, _ := tokenizer.Next()
+		if token.Kind != c.expectKind {
+			t.Error("The token kind is wrong\n")
+		}
+
+		if token.Literal != c.expectLiteral {
+			fmt.Println("expected: " + c.expectLiteral)
+			fmt.Println("but actual: " + token.Literal)
+			t.Error("The token literal is wrong\n")
+		}
+	}
+
+	// 2147483648は-2147483648のために読み，符号の有無は構文解析で検査する
+	tokenizer = New("2147483647 2147483648 2147483649")
+	token, err := tokenizer.Next()
+	if err != nil || token.Literal != "2147483647" {
+		t.Error("The max 32bit integer must be accepted\n")
+	}
+	token, err = tokenizer.Next()
+	if err != nil || token.Literal != "2147483648" {
+		t.Error("The negated min 32bit integer must be accepted\n")
+	}
+	_, err = tokenizer.Next()
+	if te, ok := err.(*TokenizeErr); !ok || te.Err != ErrOverflow {
+		t.Error("The overflowing integer must be rejected\n")
+	}
+
+	input6 := "3.14 1..2 1.5..2.5 a.b % & | ^ << >> < >"
+	case6 := []struct {
+		expectKind    Kind
+		expectLiteral string
+	}{
+		{Float, "3.14"},
+		{Num, "1"},
+		{DotDot, ".."},
+		{Num, "2"},
+		{Float, "1.5"},
+		{DotDot, ".."},
+		{Float, "2.5"},
+		{Identifier, "a"},
+		{Dot, "."},
+		{Identifier, "b"},
+		{Percent, "%"},
+		{Ampersand, "&"},
+		{Pipe, "|"},
+		{Caret, "^"},
+		{LShift, "<<"},
+		{RShift, ">>"},
+		{LessThan, "<"},
+		{GreaterThan, ">"},
+		{EOF, ""},
+	}
+	tokenizer = New(input6)
+	for _, c := range case6 {
+		token, _ := tokenizer.Next()
+		if token.Kind != c.expectKind || token.Literal != c.expectLiteral {
+			fmt.Println("expected: " + c.expectLiteral)
+			fmt.Println("but actual: " + token.Literal)
+			t.Error("The token is wrong\n")
+		}
+	}
+}
+
+func TestLoc(t *testing.T) {
+	input := "a = 1\r\nb = \"日本\" c\rd\n\n  e"
+	cases := []struct {
+		literal string
+		loc     string
+	}{
+		{"a", "main.t:1:1"},
+		{"=", "main.t:1:3"},
+		{"1", "main.t:1:5"},
+		{"b", "main.t:2:1"},
+		{"=", "main.t:2:3"},
+		{"日本", "main.t:2:5"},
+		{"c", "main.t:2:10"},
+		{"d", "main.t:3:1"},
+		{"e", "main.t:5:3"},
+		{"", "main.t:5:4"},
+	}
+	tokenizer := FromFile(NewFile("main.t", input))
+	for _, c := range cases {
+		token, err := tokenizer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Literal != c.literal || token.Loc.String() != c.loc {
+			fmt.Println("expected: " + c.literal + " at " + c.loc)
+			fmt.Println("but actual: " + token.Literal + " at " + token.Loc.String())
+			t.Error("The token location is wrong\n")
+		}
+	}
+
+	// 列は文字単位で数え，タブは揃えるために残す
+	tokenizer = New("a = 1\r\n\tb = \"é\" $")
+	var err error
+	for err == nil {
+		_, err = tokenizer.Next()
+	}
+	expected := "2:10: Syntax error, undefined token\n\tb = \"é\" $\n\t        ^"
+	if err.Error() != expected {
+		fmt.Println("expected: " + expected)
+		fmt.Println("but actual: " + err.Error())
+		t.Error("The error location is wrong\n")
+	}
+
+	// 字句エラーの後も続きを読める
+	tokenizer = New("a $ \"b\nc")
+	kinds := []Kind{}
+	errs := 0
+	for tok, err := tokenizer.Next(); tok.Kind != EOF; tok, err = tokenizer.Next() {
+		kinds = append(kinds, tok.Kind)
+		if err != nil {
+			errs++
+		}
+	}
+	if fmt.Sprint(kinds) != fmt.Sprint([]Kind{Identifier, Illegal, Illegal, Identifier}) || errs != 2 {
+		t.Errorf("The tokens after errors are wrong: %v with %d errors\n", kinds, errs)
+	}
+}
+
+func TestKindString(t *testing.T) {
+	cases := []struct {
+		kind     Kind
+		expected string
+	}{
+		{Num, "integer"},
+		{Identifier, "identifier"},
+		{LShift, "'<<'"},
+		{KeyWhile, "'while'"},
+		{KeyNumber, "'number'"},
+		{EOF, "end of input"},
+	}
+
+	for _, c := range cases {
+		if c.kind.String() != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, c.kind.String())
+		}
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	input := "# doc\n# more\nx = 1 # note\n\n\n  # inside\ny"
+	cases := []struct {
+		literal string
+		trivia  []Trivia
+	}{
+		{"x", []Trivia{{Kind: Comment, Text: "# doc"}, {Kind: Comment, Text: "# more"}}},
+		{"=", []Trivia{}},
+		{"1", []Trivia{}},
+		{"y", []Trivia{{Kind: Comment, Text: "# note", Trailing: true}, {Kind: BlankLine}, {Kind: Comment, Text: "# inside"}}},
+	}
+	tokenizer := New(input)
+	tokenizer.KeepTrivia = true
+	for _, c := range cases {
+		token, err := tokenizer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Literal != c.literal || len(token.Leading) != len(c.trivia) {
+			t.Fatalf("expected %s with %d trivia, got %s with %d", c.literal, len(c.trivia), token.Literal, len(token.Leading))
+		}
+		for i, tr := range token.Leading {
+			if tr.Kind != c.trivia[i].Kind || tr.Text != c.trivia[i].Text || tr.Trailing != c.trivia[i].Trailing {
+				t.Errorf("expected %+v before %s, got %+v", c.trivia[i], c.literal, tr)
+			}
+		}
+	}
+
+	// KeepTriviaでなければ読み飛ばすだけ
+	tokenizer = New(input)
+	for {
+		token, err := tokenizer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token.Leading) != 0 {
+			t.Errorf("expected no trivia before %s", token.Literal)
+		}
+		if token.Kind == EOF {
+			break
+		}
+	}
 }
@@ -0,0 +1,57 @@
+package token
+
+// TriviaKind express the kind of trivia as enum
+type TriviaKind int
+
+const (
+	Comment TriviaKind = iota
+	BlankLine
+)
+
+// Trivia is a comment or a blank line between tokens, kept for the tools rewriting the source
+type Trivia struct {
+	Kind TriviaKind
+	// コメントは#から行末まで，空行は空
+	Text string
+	Loc  Loc
+	// 前のトークンと同じ行にあるコメント（例: x = 1 # note）
+	Trailing bool
+}
+
+// skipTrivia skips the spaces and comments before the next token, and returns them as trivia in the KeepTrivia mode.
+// 空白の中に空の行があればBlankLineを1つ返す
+func (t *Tokenizer) skipTrivia() []Trivia {
+	trivia := []Trivia{}
+	// 前のトークンの終わり（ファイルの先頭なら0）
+	prev := t.Pos
+	for t.Pos < len(t.Input) {
+		start := t.Pos
+		switch {
+		case t.Input[t.Pos] == '#':
+			t.skipLine()
+			if !t.KeepTrivia {
+				continue
+			}
+			trivia = append(trivia, Trivia{
+				Kind:     Comment,
+				Text:     t.Input[start:t.Pos],
+				Loc:      t.File.Loc(start, t.Pos),
+				Trailing: prev > 0 && t.line(prev) == t.line(start),
+			})
+		case isSpace(t.Input[t.Pos]):
+			t.lexSpaces()
+			// 前のトークンかコメントの行と次の行の間に空の行がある
+			if t.KeepTrivia && t.line(t.Pos)-t.line(start) >= 2 {
+				trivia = append(trivia, Trivia{Kind: BlankLine, Loc: t.File.Loc(start, t.Pos)})
+			}
+		default:
+			return trivia
+		}
+	}
+	return trivia
+}
+
+func (t *Tokenizer) line(offset int) int {
+	line, _ := t.File.Position(offset)
+	return line
+}
@@ -0,0 +1,611 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
+)
+
+// Kind express the kind of a static type as enum
+type Kind int
+
+const (
+	Unknown Kind = iota
+	Num
+	Float
+	Bool
+	Range
+	Instance
+	Tuple
+	Error
+)
+
+// Type is the static type of an expression. Class is set for Instance, Size for Tuple
+type Type struct {
+	Kind  Kind
+	Class string
+	Size  int
+}
+
+func (t Type) String() string {
+	switch t.Kind {
+	case Num:
+		return "number"
+	case Float:
+		return "float"
+	case Bool:
+		return "bool"
+	case Range:
+		return "range"
+	case Instance:
+		return t.Class
+	case Tuple:
+		return fmt.Sprintf("%d values", t.Size)
+	case Error:
+		return "error"
+	}
+	return "unknown"
+}
+
+type TypeErr struct {
+	Err error
+	L   token.Loc
+	Msg string
+}
+
+// custom error
+var (
+	ErrMismatch  = errors.New("Type error")
+	ErrArity     = errors.New("Arity error")
+	ErrUndefined = errors.New("Undefined error")
+)
+
+func (te *TypeErr) Error() string {
+	// 位置の分からないノードはメッセージだけ
+	if te.L.File == nil && te.L.Line == 0 {
+		return fmt.Sprintf("%v: %s", te.Err, te.Msg)
+	}
+	return fmt.Sprintf("%v: %v: %s\n%v", te.L, te.Err, te.Msg, te.L.Show())
+}
+
+// FromValType converts the type of an annotation to a static type
+func FromValType(vt parser.IdentValType) Type {
+	switch vt {
+	case parser.Num, parser.Include, parser.Exclude, parser.Constrained:
+		return Type{Kind: Num}
+	case parser.Bool:
+		return Type{Kind: Bool}
+	case parser.Range:
+		return Type{Kind: Range}
+	}
+	return Type{Kind: Unknown}
+}
+
+type class struct {
+	methods map[string]parser.FunctionDef
+	vals    map[string]Type
+}
+
+type scope struct {
+	vars map[string]Type
+	// 型注釈で宣言された変数
+	declared map[string]bool
+	fn       *parser.FunctionDef
+}
+
+func newScope(fn *parser.FunctionDef) *scope {
+	return &scope{vars: map[string]Type{}, declared: map[string]bool{}, fn: fn}
+}
+
+// Checker infers the types of a program and collects the mismatches it finds
+type Checker struct {
+	funcs   map[string]parser.FunctionDef
+	classes map[string]*class
+	methods map[string]bool
+	scopes  []*scope
+	class   string
+	errs    []error
+}
+
+// Check walks the program and returns the type errors found in it
+func Check(program []parser.Node) []error {
+	return NewChecker().Check(program)
+}
+
+// NewChecker returns a Checker keeping the names defined by the programs it checks
+func NewChecker() *Checker {
+	return &Checker{
+		funcs:   map[string]parser.FunctionDef{},
+		classes: map[string]*class{},
+		methods: map[string]bool{},
+		scopes:  []*scope{newScope(nil)},
+	}
+}
+
+// Check checks program as the continuation of the programs checked before (REPL用)
+func (c *Checker) Check(program []parser.Node) []error {
+	c.errs = nil
+	// 定義前の呼び出しも検査できるように関数とクラスを先に集める
+	for _, n := range program {
+		switch node := n.(type) {
+		case parser.FunctionDef:
+			c.funcs[node.Ident.Name] = node
+		case parser.ClassDef:
+			cl := &class{methods: map[string]parser.FunctionDef{}, vals: map[string]Type{}}
+			for _, m := range node.Methods {
+				cl.methods[m.Ident.Name] = m
+				c.methods[m.Ident.Name] = true
+			}
+			c.classes[node.Ident.Name] = cl
+		}
+	}
+	for _, n := range program {
+		c.stmt(n)
+	}
+	return c.errs
+}
+
+func (c *Checker) errorf(n parser.Node, err error, format string, a ...interface{}) {
+	c.errorAt(n.Pos(), err, format, a...)
+}
+
+func (c *Checker) errorAt(loc token.Loc, err error, format string, a ...interface{}) {
+	c.errs = append(c.errs, &TypeErr{err, loc, fmt.Sprintf(format, a...)})
+}
+
+func (c *Checker) currentScope() *scope {
+	return c.scopes[len(c.scopes)-1]
+}
+
+func (c *Checker) resolve(name string) (Type, bool) {
+	t, ok := c.currentScope().vars[name]
+	if ok {
+		return t, true
+	}
+	t, ok = c.scopes[0].vars[name]
+	return t, ok
+}
+
+func (c *Checker) stmt(n parser.Node) {
+	switch node := n.(type) {
+	case parser.AssignStmt:
+		c.bind(node.Ident, c.expr(node.Expr))
+	case parser.MultiAssignStmt:
+		c.multiAssign(node)
+	case parser.IfStmt:
+		c.condition("if", node.Condition)
+		c.block(node.Block)
+	case parser.WhileStmt:
+		c.condition("while", node.Condition)
+		c.block(node.Block)
+	case parser.CaseStmt:
+		subject := c.expr(node.Subject)
+		for _, when := range node.Whens {
+			for _, pattern := range when.Patterns {
+				c.pattern(pattern, subject, c.expr(pattern))
+			}
+			c.block(when.Block)
+		}
+		if node.Else != nil {
+			c.block(*node.Else)
+		}
+	case parser.RaiseStmt:
+		t := c.expr(node.Expr)
+		if t.Kind == Tuple {
+			c.errorf(node, ErrMismatch, "cannot raise %v", t)
+		}
+	case parser.BeginStmt:
+		c.block(node.Block)
+		if node.Rescue != nil {
+			if node.Ident != nil {
+				c.bind(*node.Ident, Type{Kind: Error})
+			}
+			c.block(*node.Rescue)
+		}
+		if node.Ensure != nil {
+			c.block(*node.Ensure)
+		}
+	case parser.ReturnStmt:
+		t := c.expr(node.Expr)
+		fn := c.currentScope().fn
+		if fn == nil {
+			return
+		}
+		want := FromValType(fn.Result.ValType)
+		if !compatible(want, t) {
+			c.errorf(node, ErrMismatch, "%s must return %v, not %v", fn.Ident.Name, want, t)
+			return
+		}
+		// 制約は定数のときだけ静的に検査し，それ以外はVMに任せる
+		if lit, ok := node.Expr.(parser.IntegerLiteral); ok && !satisfies(lit.Val, fn.Result) {
+			c.errorf(node, ErrMismatch, "%s returns %d outside its result constraint", fn.Ident.Name, lit.Val)
+		}
+	case parser.FunctionDef:
+		c.function(node)
+	case parser.ImportStmt:
+	case parser.ClassDef:
+		c.class = node.Ident.Name
+		for _, m := range node.Methods {
+			c.function(m)
+		}
+		c.class = ""
+	default:
+		c.expr(n)
+	}
+}
+
+func (c *Checker) block(b parser.BlockStmt) {
+	for _, n := range b.Nodes {
+		c.stmt(n)
+	}
+}
+
+func (c *Checker) condition(construct string, n parser.Node) {
+	t := c.expr(n)
+	if t.Kind != Unknown && t.Kind != Bool {
+		c.errorf(n, ErrMismatch, "%s condition must be bool, not %v", construct, t)
+	}
+}
+
+// pattern checks a when pattern of type p can match a subject of type t
+func (c *Checker) pattern(n parser.Node, t, p Type) {
+	if t.Kind == Unknown || p.Kind == Unknown {
+		return
+	}
+	if p.Kind == Range {
+		if !t.isNumeric() {
+			c.errorf(n, ErrMismatch, "cannot match %v with range", t)
+		}
+		return
+	}
+	if t != p && !(t.isNumeric() && p.isNumeric()) {
+		c.errorf(n, ErrMismatch, "cannot match %v with %v", t, p)
+	}
+}
+
+func (c *Checker) function(f parser.FunctionDef) {
+	s := newScope(&f)
+	for _, arg := range f.Args {
+		s.vars[arg.Name] = FromValType(arg.ValType)
+		s.declared[arg.Name] = arg.ValType != parser.Any
+	}
+	c.scopes = append(c.scopes, s)
+	c.block(f.Block)
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	if f.Result.ValType != parser.Any && !returns(f.Block.Nodes) {
+		c.errorAt(f.End(), ErrMismatch, "%s may end without returning %v", f.Ident.Name, FromValType(f.Result.ValType))
+	}
+}
+
+// returns reports whether every path through nodes ends with a return or a raise
+func returns(nodes []parser.Node) bool {
+	for _, n := range nodes {
+		switch node := n.(type) {
+		case parser.ReturnStmt, parser.RaiseStmt:
+			return true
+		case parser.CaseStmt:
+			// elseがなければ何にも一致せずに抜けうる
+			if node.Else == nil || !returns(node.Else.Nodes) {
+				continue
+			}
+			all := true
+			for _, when := range node.Whens {
+				all = all && returns(when.Block.Nodes)
+			}
+			if all {
+				return true
+			}
+		case parser.BeginStmt:
+			if node.Ensure != nil && returns(node.Ensure.Nodes) {
+				return true
+			}
+			// 本体が例外で抜けたときはrescueが続きを受け持つ
+			if returns(node.Block.Nodes) && (node.Rescue == nil || returns(node.Rescue.Nodes)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Checker) multiAssign(m parser.MultiAssignStmt) {
+	if tuple, ok := m.Expr.(parser.TupleExpr); ok {
+		if len(tuple.Elems) != len(m.Idents) {
+			c.errorf(m, ErrArity, "cannot assign %d values to %d variables", len(tuple.Elems), len(m.Idents))
+		}
+		for i, elem := range tuple.Elems {
+			t := c.expr(elem)
+			if i < len(m.Idents) {
+				c.bind(m.Idents[i], t)
+			}
+		}
+		return
+	}
+	t := c.expr(m.Expr)
+	if t.Kind == Tuple && t.Size != len(m.Idents) {
+		c.errorf(m, ErrArity, "cannot assign %d values to %d variables", t.Size, len(m.Idents))
+	} else if t.Kind != Unknown && t.Kind != Tuple {
+		c.errorf(m, ErrMismatch, "cannot destructure %v", t)
+	}
+	for _, ident := range m.Idents {
+		c.bind(ident, Type{Kind: Unknown})
+	}
+}
+
+// bind records that a value of type t is assigned to ident, checking its declared type
+func (c *Checker) bind(ident parser.IdentExpr, t Type) {
+	if ident.FSelf {
+		cl, ok := c.classes[c.class]
+		if !ok {
+			return
+		}
+		if ident.ValType != parser.Any {
+			cl.vals[ident.Name] = FromValType(ident.ValType)
+		}
+		want, ok := cl.vals[ident.Name]
+		if ok && !compatible(want, t) {
+			c.errorf(ident, ErrMismatch, "cannot assign %v to self.%s of type %v", t, ident.Name, want)
+		}
+		return
+	}
+
+	s := c.currentScope()
+	if ident.ValType != parser.Any {
+		s.vars[ident.Name] = FromValType(ident.ValType)
+		s.declared[ident.Name] = true
+	}
+	if s.declared[ident.Name] {
+		want := s.vars[ident.Name]
+		if !compatible(want, t) {
+			c.errorf(ident, ErrMismatch, "cannot assign %v to %s of type %v", t, ident.Name, want)
+		}
+		return
+	}
+	s.vars[ident.Name] = t
+}
+
+func (c *Checker) expr(n parser.Node) Type {
+	switch node := n.(type) {
+	case parser.IntegerLiteral:
+		return Type{Kind: Num}
+	case parser.FloatLiteral:
+		return Type{Kind: Float}
+	case parser.BoolLiteral:
+		return Type{Kind: Bool}
+	case parser.IntegerRangeLiteral:
+		return Type{Kind: Range}
+	case parser.TupleExpr:
+		for _, elem := range node.Elems {
+			c.expr(elem)
+		}
+		return Type{Kind: Tuple, Size: len(node.Elems)}
+	case parser.InfixExpr:
+		return c.infix(node)
+	case parser.IdentExpr:
+		if node.FSelf {
+			if cl, ok := c.classes[c.class]; ok {
+				return cl.vals[node.Name]
+			}
+			return Type{Kind: Unknown}
+		}
+		t, ok := c.resolve(node.Name)
+		if _, isFunc := c.funcs[node.Name]; !ok && !isFunc {
+			c.errorf(node, ErrUndefined, "undefined variable %s", node.Name)
+		}
+		return t
+	case parser.CallExpr:
+		return c.call(node)
+	case parser.InstantiationExpr:
+		for _, arg := range node.Args {
+			c.expr(arg)
+		}
+		cl, ok := c.classes[node.Ident.Name]
+		if !ok {
+			c.errorf(node, ErrUndefined, "undefined class %s", node.Ident.Name)
+			return Type{Kind: Unknown}
+		}
+		if init, ok := cl.methods["init"]; ok {
+			c.arity(node, node.Ident.Name, init, node.Args)
+		} else if len(node.Args) > 0 {
+			c.errorf(node, ErrArity, "%s takes 0 arguments but %d given", node.Ident.Name, len(node.Args))
+		}
+		return Type{Kind: Instance, Class: node.Ident.Name}
+	case parser.CallMethodExpr:
+		return c.callMethod(node)
+	case parser.KeywordArg:
+		return c.expr(node.Expr)
+	case parser.SplatExpr:
+		t := c.expr(node.Expr)
+		if t.Kind != Unknown && t.Kind != Tuple {
+			c.errorf(node, ErrMismatch, "cannot splat %v", t)
+		}
+		return Type{Kind: Unknown}
+	}
+	return Type{Kind: Unknown}
+}
+
+func (c *Checker) infix(i parser.InfixExpr) Type {
+	l := c.expr(i.Left)
+	r := c.expr(i.Right)
+	switch i.Op {
+	case parser.EQ, parser.NEQ:
+		if l.Kind != Unknown && r.Kind != Unknown && l != r && !(l.isNumeric() && r.isNumeric()) {
+			c.errorf(i, ErrMismatch, "cannot compare %v with %v", l, r)
+		}
+		return Type{Kind: Bool}
+	case parser.Less, parser.Greater:
+		c.operands(i, l, r)
+		return Type{Kind: Bool}
+	case parser.BitAnd, parser.BitOr, parser.BitXor, parser.Shl, parser.Shr:
+		// ビット演算は整数のみ
+		for _, t := range []Type{l, r} {
+			if t.Kind != Unknown && t.Kind != Num {
+				c.errorf(i, ErrMismatch, "invalid operand %v for %v", t, i.Op)
+				break
+			}
+		}
+		return Type{Kind: Num}
+	}
+	c.operands(i, l, r)
+	// 小数が混ざれば結果は小数
+	if l.Kind == Float || r.Kind == Float {
+		return Type{Kind: Float}
+	}
+	return Type{Kind: Num}
+}
+
+// operands checks both operands of an arithmetic or ordering operator are numbers
+func (c *Checker) operands(i parser.InfixExpr, l, r Type) {
+	for _, t := range []Type{l, r} {
+		if t.Kind != Unknown && !t.isNumeric() {
+			c.errorf(i, ErrMismatch, "invalid operand %v for %v", t, i.Op)
+			return
+		}
+	}
+}
+
+func (c *Checker) call(call parser.CallExpr) Type {
+	for _, arg := range call.Args {
+		c.expr(arg)
+	}
+	// 変数に束縛された関数は静的には追えない
+	if _, ok := c.resolve(call.Ident.Name); ok {
+		return Type{Kind: Unknown}
+	}
+	f, ok := c.funcs[call.Ident.Name]
+	if !ok {
+		c.errorf(call, ErrUndefined, "undefined function %s", call.Ident.Name)
+		return Type{Kind: Unknown}
+	}
+	c.arity(call, call.Ident.Name, f, call.Args)
+	return FromValType(f.Result.ValType)
+}
+
+func (c *Checker) callMethod(cm parser.CallMethodExpr) Type {
+	recv := c.expr(cm.Receiver)
+	call, ok := cm.Method.(parser.CallExpr)
+	if !ok {
+		return Type{Kind: Unknown}
+	}
+	for _, arg := range call.Args {
+		c.expr(arg)
+	}
+	name := call.Ident.Name
+	if recv.Kind == Instance {
+		m, ok := c.classes[recv.Class].methods[name]
+		if !ok {
+			c.errorf(cm, ErrUndefined, "undefined method %s for %s", name, recv.Class)
+			return Type{Kind: Unknown}
+		}
+		c.arity(cm, recv.Class+"."+name, m, call.Args)
+		return FromValType(m.Result.ValType)
+	}
+	if recv.Kind != Unknown {
+		c.errorf(cm, ErrUndefined, "undefined method %s for %v", name, recv)
+		return Type{Kind: Unknown}
+	}
+	if !c.methods[name] {
+		c.errorf(cm, ErrUndefined, "undefined method %s", name)
+	}
+	return Type{Kind: Unknown}
+}
+
+// arity checks the arguments of a call match the parameters of f, taking defaults, keywords and rest parameter into account
+func (c *Checker) arity(at parser.Node, name string, f parser.FunctionDef, args []parser.Node) {
+	params := f.Params()
+	given := map[string]bool{}
+	n := 0
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case parser.SplatExpr:
+			// 展開される数は静的に分からない
+			return
+		case parser.KeywordArg:
+			known := false
+			for _, param := range params {
+				known = known || param.Name == arg.Name
+			}
+			if !known {
+				c.errorf(arg, ErrUndefined, "unknown keyword %s for %s", arg.Name, name)
+				return
+			}
+			if given[arg.Name] {
+				c.errorf(arg, ErrArity, "argument %s given twice for %s", arg.Name, name)
+				return
+			}
+			given[arg.Name] = true
+		default:
+			if n < len(params) {
+				given[params[n].Name] = true
+			}
+			n++
+		}
+	}
+	if n > len(params) && !f.Variadic {
+		c.errorf(at, ErrArity, "%s takes %d arguments but %d given", name, len(params), n)
+		return
+	}
+	for i, param := range params {
+		if !given[param.Name] && (i >= len(f.Defaults) || f.Defaults[i] == nil) {
+			if len(params) == f.Required() && !f.Variadic {
+				c.errorf(at, ErrArity, "%s takes %d arguments but %d given", name, len(params), len(args))
+			} else {
+				c.errorf(at, ErrArity, "missing argument %s for %s", param.Name, name)
+			}
+			return
+		}
+	}
+}
+
+func (t Type) isNumeric() bool {
+	return t.Kind == Num || t.Kind == Float
+}
+
+// compatible reports whether a value of type got can be stored where want is expected.
+// number型には小数も格納できる
+func compatible(want, got Type) bool {
+	if want.Kind == Num && got.Kind == Float {
+		return true
+	}
+	return want.Kind == Unknown || got.Kind == Unknown || want == got
+}
+
+// satisfies reports whether val meets the range constraint of decl. Predicates are left to the VM
+func satisfies(val int, decl parser.IdentExpr) bool {
+	in := func(r parser.IntegerRangeLiteral) bool {
+		return r.From.Val <= val && val <= r.To.Val
+	}
+	switch decl.ValType {
+	case parser.Include:
+		return in(decl.ValLimit)
+	case parser.Exclude:
+		return !in(decl.ValLimit)
+	case parser.Constrained:
+		cons := decl.Constraint
+		if len(cons.Include) > 0 {
+			ok := false
+			for _, r := range cons.Include {
+				ok = ok || in(r)
+			}
+			if !ok {
+				return false
+			}
+		}
+		for _, r := range cons.Exclude {
+			if in(r) {
+				return false
+			}
+		}
+		if len(cons.In) > 0 {
+			for _, v := range cons.In {
+				if v.Val == val {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
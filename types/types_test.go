@@ -0,0 +1,134 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
+)
+
+func TestCheck(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"a = 1 + 2 a > 1", []string{}},
+		{"1 + true", []string{"Type error: invalid operand bool for +"}},
+		{"1 == true", []string{"Type error: cannot compare number with bool"}},
+		{"a: number = 1.5 * 2 a == 3", []string{}},
+		{"1.5 + false", []string{"Type error: invalid operand bool for +"}},
+		{"a = 1 << 2 | 7 % 3 a = 1.5 & 1", []string{"Type error: invalid operand float for &"}},
+		{"if 0.5 do end", []string{"Type error: if condition must be bool, not float"}},
+		{"if 5 do end", []string{"Type error: if condition must be bool, not number"}},
+		{"while 1 < 2 do end", []string{}},
+		{"a: number = true", []string{"Type error: cannot assign bool to a of type number"}},
+		{"a: {include: 1..3} = 2 a = false", []string{"Type error: cannot assign bool to a of type number"}},
+		{"def f(a: bool) return a + 1 end", []string{"Type error: invalid operand bool for +"}},
+		{"def f(a): number return a == 1 end", []string{"Type error: f must return number, not bool"}},
+		{"def f(a): number if a do return 1 end end", []string{"Type error: f may end without returning number"}},
+		{"def f(a): number case a when 1 then return 1 else raise 2 end end", []string{}},
+		{"def f(a): number begin return a / 0 rescue return 0 end end", []string{}},
+		{"def f(a): number begin return a rescue end end", []string{"Type error: f may end without returning number"}},
+		{"def f(): {include: 1..3} return 5 end def g(): {in: [-1, 1]} return -1 end", []string{"Type error: f returns 5 outside its result constraint"}},
+		{"def f(a, b) return a end f(1)", []string{"Arity error: f takes 2 arguments but 1 given"}},
+		{"g(1)", []string{"Undefined error: undefined function g"}},
+		{"a = b + 1", []string{"Undefined error: undefined variable b"}},
+		{"def f(x) return x + y end", []string{"Undefined error: undefined variable y"}},
+		{"def f(a, b = 2) return a end f(1) f(1, 3) f(b: 1, a: 2)", []string{}},
+		{"def f(a, b = 2) return a end f(b: 1)", []string{"Arity error: missing argument a for f"}},
+		{"def f(a, b = 2) return a end f(1, a: 1)", []string{"Arity error: argument a given twice for f"}},
+		{"def f(a, b = 2) return a end f(1, c: 1)", []string{"Undefined error: unknown keyword c for f"}},
+		{"def f(a, b = 2) return a end f(1, 2, 3)", []string{"Arity error: f takes 2 arguments but 3 given"}},
+		{"def f(a, *xs) return a end f(1, 2, 3) t = 1, 2 f(*t)", []string{}},
+		{"def f(a, *xs) return a end f()", []string{"Arity error: missing argument a for f"}},
+		{"def f(a, *xs) return a end f(*1)", []string{"Type error: cannot splat number"}},
+		{"x = 1 case x when 1, 2..3 then a = 1 else a = 2 end", []string{}},
+		{"x = 1 case x when true then a = 1 end", []string{"Type error: cannot match number with bool"}},
+		{"x = true case x when 1..2 then a = 1 + false end", []string{"Type error: cannot match bool with range", "Type error: invalid operand bool for +"}},
+		{"begin raise 1 rescue e raise e ensure a = 1 end", []string{}},
+		{"t = 1, 2 raise t", []string{"Type error: cannot raise 2 values"}},
+		{"begin a = 1 rescue e a = e + 1 end", []string{"Type error: invalid operand error for +"}},
+		{"a, b = 1, true a + 1", []string{}},
+		{"a, b = 1, true b + 1", []string{"Type error: invalid operand bool for +"}},
+		{"a, b = 1, 2, 3", []string{"Arity error: cannot assign 3 values to 2 variables"}},
+		{"a, b = 1", []string{"Type error: cannot destructure number"}},
+		{"def f(): number return 1, 2 end", []string{"Type error: f must return number, not 2 values"}},
+		{"def f(): bool return true end if f() do end 1 + f()", []string{"Type error: invalid operand bool for +"}},
+		{
+			`
+class LED
+  def init(pin)
+    self.pin: number = pin
+  end
+  def on()
+    return self.pin + 1
+  end
+end
+a = LED(1)
+a.on()
+a.off()
+b = LED()
+b.on(1)`,
+			[]string{
+				"Undefined error: undefined method off for LED",
+				"Arity error: LED takes 1 arguments but 0 given",
+				"Arity error: LED.on takes 0 arguments but 1 given",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		p, err := parser.New(token.New(c.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		program, err := p.Program()
+		if err != nil {
+			t.Fatal(err)
+		}
+		errs := Check(program)
+		if len(errs) != len(c.expected) {
+			fmt.Println("input: " + c.input)
+			fmt.Println(errs)
+			t.Error("wrong number of type errors\n")
+			continue
+		}
+		for i, err := range errs {
+			te := err.(*TypeErr)
+			actual := fmt.Sprintf("%v: %s", te.Err, te.Msg)
+			if actual != c.expected[i] {
+				fmt.Println("expected: " + c.expected[i])
+				fmt.Println("but actual: " + actual)
+				t.Error("wrong type error\n")
+			}
+		}
+	}
+}
+
+func TestErrLoc(t *testing.T) {
+	input := "a = 1\nif a do\n  b = c + 1\nend\ndef f(x): bool\n  return x\nend\nf(1, 2)\ndef g(x): number\n  if x do\n    return 1\n  end\nend"
+	expected := []string{
+		"main.t:2:4: Type error: if condition must be bool, not number\nif a do\n   ^",
+		"main.t:3:7: Undefined error: undefined variable c\n  b = c + 1\n      ^",
+		"main.t:8:1: Arity error: f takes 1 arguments but 2 given\nf(1, 2)\n^",
+		"main.t:13:1: Type error: g may end without returning number\nend\n^",
+	}
+	p, err := parser.New(token.FromFile(token.NewFile("main.t", input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := p.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := Check(program)
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if err.Error() != expected[i] {
+			t.Errorf("expected:\n%s\nbut actual:\n%s", expected[i], err.Error())
+		}
+	}
+}
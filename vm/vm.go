@@ -0,0 +1,647 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/takeru56/tcompiler/code"
+	"github.com/takeru56/tcompiler/compiler"
+	"github.com/takeru56/tcompiler/obj"
+)
+
+// MaxFrames is the deepest call the VM runs before raising a stack overflow
+const MaxFrames = 1024
+
+// RuntimeErr is an error raised and not rescued while running
+type RuntimeErr struct {
+	Err *obj.Error
+	// エラーが伝わった関数（内側から順に）. デバッグ情報のない関数は含まない
+	Trace []Caller
+}
+
+// Caller is a function the error passed through and the line it was running
+type Caller struct {
+	Name string
+	Line int
+}
+
+func (re *RuntimeErr) Error() string {
+	s := "Runtime error: " + re.Err.Msg
+	if re.Err.Code == obj.ErrRaised {
+		s = "Runtime error: uncaught " + re.Err.Value.Inspect()
+	}
+	// 再帰で同じ位置が続くときはまとめる
+	for i := 0; i < len(re.Trace); {
+		n := 1
+		for i+n < len(re.Trace) && re.Trace[i+n] == re.Trace[i] {
+			n++
+		}
+		s += fmt.Sprintf("\n\tat %s line %d", re.Trace[i].Name, re.Trace[i].Line)
+		if n > 1 {
+			s += fmt.Sprintf(" (%d times)", n)
+		}
+		i += n
+	}
+	return s
+}
+
+// Frame is the state of a running function. トップレベルではfnがnil
+type Frame struct {
+	fn       *obj.Function
+	ins      code.Instructions
+	handlers []obj.Handler
+	pool     []obj.Object
+	// 次に実行する位置と，実行中の命令の位置
+	ip int
+	pc int
+	// 呼び出し時のスタックの高さ
+	base   int
+	locals []obj.Object
+	self   *obj.Instance
+	debug  *obj.Debug
+}
+
+// VM runs compiled bytecode in process
+type VM struct {
+	constants []obj.Object
+	classes   []obj.Class
+	globals   []obj.Object
+	stack     []obj.Object
+	frames    []*Frame
+	result    obj.Object
+	// 捕捉されないまま取り除いたフレーム
+	trace []Caller
+}
+
+func New(b *compiler.Bytecode) *VM {
+	main := &Frame{ins: b.Instructions, handlers: b.Handlers, pool: b.Constants, debug: b.Debug}
+	return &VM{constants: b.Constants, classes: b.Classes, globals: []obj.Object{}, stack: []obj.Object{}, frames: []*Frame{main}}
+}
+
+// Run executes the top level until OpDone
+func (vm *VM) Run() error {
+	if err := vm.run(0); err != nil {
+		return &RuntimeErr{err, vm.trace}
+	}
+	return nil
+}
+
+// Resume runs the top level of b, a program compiled after the one run before by the same compiler.
+// グローバル変数は前の実行のものを引き継ぐ（REPL用）
+func (vm *VM) Resume(b *compiler.Bytecode) error {
+	vm.constants = b.Constants
+	vm.classes = b.Classes
+	vm.stack = []obj.Object{}
+	vm.frames = []*Frame{{ins: b.Instructions, handlers: b.Handlers, pool: b.Constants, debug: b.Debug}}
+	vm.result = nil
+	vm.trace = nil
+	return vm.Run()
+}
+
+// Result returns the value on the stack top when the top level finished, or nil
+func (vm *VM) Result() obj.Object {
+	return vm.result
+}
+
+// run executes instructions until the frames above depth have returned.
+// 捕捉されなかったエラーはdepthより上のフレームを取り除いて返す
+func (vm *VM) run(depth int) *obj.Error {
+	for len(vm.frames) > depth {
+		f := vm.frames[len(vm.frames)-1]
+		if f.ip >= len(f.ins) {
+			return vm.fail(obj.ErrType, "missing OpDone or OpReturn")
+		}
+		f.pc = f.ip
+		def, err := code.Lookup(f.ins[f.ip])
+		if err != nil {
+			return vm.fail(obj.ErrType, err.Error())
+		}
+		operands, n := code.ReadOperands(def, f.ins[f.ip+1:])
+		f.ip += 1 + n
+		if e := vm.exec(f, code.Opcode(f.ins[f.pc]), operands); e != nil {
+			if !vm.raise(e, depth) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// raise jumps to the innermost handler covering the failed instruction
+func (vm *VM) raise(e *obj.Error, depth int) bool {
+	for len(vm.frames) > depth {
+		f := vm.frames[len(vm.frames)-1]
+		for _, h := range f.handlers {
+			if h.Start <= f.pc && f.pc < h.End {
+				vm.stack = vm.stack[:f.base]
+				vm.push(e)
+				f.ip = h.Target
+				vm.trace = nil
+				return true
+			}
+		}
+		if f.debug != nil {
+			vm.trace = append(vm.trace, Caller{f.debug.Name, f.debug.LineAt(f.pc)})
+		}
+		vm.frames = vm.frames[:len(vm.frames)-1]
+		vm.stack = vm.stack[:f.base]
+	}
+	return false
+}
+
+func (vm *VM) fail(code obj.ErrorCode, format string, a ...interface{}) *obj.Error {
+	return &obj.Error{Code: code, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (vm *VM) exec(f *Frame, op code.Opcode, operands []int) *obj.Error {
+	switch op {
+	case code.OpConstant:
+		if operands[0] < 1 || operands[0] > len(f.pool) {
+			return vm.fail(obj.ErrType, "undefined constant %d", operands[0])
+		}
+		vm.push(f.pool[operands[0]-1])
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpAnd, code.OpOr, code.OpXor, code.OpShl, code.OpShr:
+		b := vm.pop()
+		a := vm.pop()
+		v, err := arith(op, a, b)
+		if err != nil {
+			return err
+		}
+		vm.push(v)
+	case code.OpEQ:
+		b := vm.pop()
+		vm.push(boolean(equal(vm.pop(), b)))
+	case code.OpNEQ:
+		b := vm.pop()
+		vm.push(boolean(!equal(vm.pop(), b)))
+	case code.OpLess, code.OpGreater:
+		b := vm.pop()
+		a := vm.pop()
+		x, okA := toFloat(a)
+		y, okB := toFloat(b)
+		if !okA || !okB {
+			return vm.fail(obj.ErrType, "cannot compare %s with %s", a.Inspect(), b.Inspect())
+		}
+		if op == code.OpLess {
+			vm.push(boolean(x < y))
+		} else {
+			vm.push(boolean(x > y))
+		}
+	case code.OpLoadGlobal:
+		if operands[0] >= len(vm.globals) || vm.globals[operands[0]] == nil {
+			return vm.fail(obj.ErrType, "undefined global %d", operands[0])
+		}
+		vm.push(vm.globals[operands[0]])
+	case code.OpStoreGlobal:
+		vm.storeGlobal(operands[0], vm.pop())
+	case code.OpStoreGlobalChecked:
+		v, err := vm.checked(f, operands[1])
+		if err != nil {
+			return err
+		}
+		vm.storeGlobal(operands[0], v)
+	case code.OpLoadLocal:
+		if operands[0] >= len(f.locals) || f.locals[operands[0]] == nil {
+			return vm.fail(obj.ErrType, "undefined local %d", operands[0])
+		}
+		vm.push(f.locals[operands[0]])
+	case code.OpStoreLocal:
+		storeLocal(f, operands[0], vm.pop())
+	case code.OpStoreLocalChecked:
+		v, err := vm.checked(f, operands[1])
+		if err != nil {
+			return err
+		}
+		storeLocal(f, operands[0], v)
+	case code.OpJNT:
+		cond, ok := vm.pop().(*obj.Bool)
+		if !ok {
+			return vm.fail(obj.ErrType, "condition must be bool")
+		}
+		if cond.Value == 0 {
+			f.ip = operands[0]
+		}
+	case code.OpJMP:
+		f.ip = operands[0]
+	case code.OpCall:
+		args := vm.popN(operands[0])
+		return vm.call(vm.pop(), args, nil, vm.constants)
+	case code.OpCallSplat:
+		args, err := vm.spread(vm.popN(operands[0]), operands[1])
+		if err != nil {
+			return err
+		}
+		return vm.call(vm.pop(), args, nil, vm.constants)
+	case code.OpCallMethod, code.OpCallMethodSplat:
+		args := vm.popN(operands[0])
+		if op == code.OpCallMethodSplat {
+			var err *obj.Error
+			args, err = vm.spread(args, operands[1])
+			if err != nil {
+				return err
+			}
+		}
+		method := vm.pop()
+		self := vm.pop().(*obj.Instance)
+		return vm.call(method, args, self, self.Class.ConstantPool)
+	case code.OpReturnValue:
+		v := vm.pop()
+		if f.fn != nil {
+			var limit obj.Object
+			if f.fn.RetLimit > 0 {
+				limit = f.pool[f.fn.RetLimit-1]
+			}
+			if err := vm.check(f, v, f.fn.RetType, limit); err != nil {
+				return err
+			}
+		}
+		vm.ret(v)
+	case code.OpReturn:
+		// initはインスタンスを返す
+		if f.self != nil && f.fn.Id == 0 {
+			vm.ret(f.self)
+			return nil
+		}
+		vm.ret(&obj.Nil{})
+	case code.OpInstance:
+		class := &vm.classes[operands[0]]
+		vm.push(&obj.Instance{Class: class, Vals: make([]obj.Object, class.NumInstanceVal)})
+	case code.OpLoadMethod:
+		self, ok := vm.top().(*obj.Instance)
+		if !ok {
+			return vm.fail(obj.ErrType, "%s has no methods", vm.top().Inspect())
+		}
+		method := findFunction(self.Class.ConstantPool, operands[0])
+		if method == nil {
+			return vm.fail(obj.ErrType, "undefined method %d for %s", operands[0], self.Class.Name)
+		}
+		vm.push(method)
+	case code.OpLoadInstanceVal:
+		if f.self == nil || operands[0] >= len(f.self.Vals) || f.self.Vals[operands[0]] == nil {
+			return vm.fail(obj.ErrType, "undefined instance val %d", operands[0])
+		}
+		vm.push(f.self.Vals[operands[0]])
+	case code.OpStoreInstanceVal:
+		v, err := vm.checked(f, operands[1])
+		if err != nil {
+			return err
+		}
+		for len(f.self.Vals) <= operands[0] {
+			f.self.Vals = append(f.self.Vals, nil)
+		}
+		f.self.Vals[operands[0]] = v
+	case code.OpTuple:
+		vm.push(&obj.Tuple{Elems: vm.popN(operands[0])})
+	case code.OpUnpack:
+		v := vm.pop()
+		t, ok := v.(*obj.Tuple)
+		if !ok {
+			return vm.fail(obj.ErrType, "cannot unpack %s", v.Inspect())
+		}
+		if len(t.Elems) != operands[0] {
+			return vm.fail(obj.ErrArity, "cannot unpack %d values into %d", len(t.Elems), operands[0])
+		}
+		for _, e := range t.Elems {
+			vm.push(e)
+		}
+	case code.OpDup:
+		vm.push(vm.top())
+	case code.OpPop:
+		vm.pop()
+	case code.OpMatch:
+		p := vm.pop()
+		v := vm.pop()
+		if r, ok := p.(*obj.Range); ok {
+			i, ok := v.(*obj.Integer)
+			vm.push(boolean(ok && r.From <= i.Value && i.Value <= r.To))
+			return nil
+		}
+		vm.push(boolean(equal(v, p)))
+	case code.OpJumpTable:
+		table := f.pool[operands[0]-1].(*obj.JumpTable)
+		f.ip = table.Default
+		if i, ok := vm.pop().(*obj.Integer); ok && table.Min <= i.Value && i.Value < table.Min+len(table.Targets) {
+			f.ip = table.Targets[i.Value-table.Min]
+		}
+	case code.OpRaise:
+		v := vm.pop()
+		if e, ok := v.(*obj.Error); ok {
+			return e
+		}
+		return &obj.Error{Code: obj.ErrRaised, Value: v}
+	case code.OpDone:
+		if len(vm.stack) > 0 {
+			vm.result = vm.top()
+		}
+		vm.frames = vm.frames[:len(vm.frames)-1]
+	default:
+		return vm.fail(obj.ErrType, "unsupported opcode %d", op)
+	}
+	return nil
+}
+
+// call pushes the frame of fn. 可変長引数の関数では固定引数より後ろをタプルにまとめる
+func (vm *VM) call(callee obj.Object, args []obj.Object, self *obj.Instance, pool []obj.Object) *obj.Error {
+	fn, ok := callee.(*obj.Function)
+	if !ok {
+		return vm.fail(obj.ErrType, "cannot call %s", callee.Inspect())
+	}
+	if fn.Variadic {
+		fixed := fn.NumArg - 1
+		if len(args) < fixed {
+			return vm.fail(obj.ErrArity, "function %d takes at least %d arguments but %d given", fn.Id, fixed, len(args))
+		}
+		rest := &obj.Tuple{Elems: append([]obj.Object{}, args[fixed:]...)}
+		args = append(args[:fixed:fixed], rest)
+	} else if len(args) != fn.NumArg {
+		return vm.fail(obj.ErrArity, "function %d takes %d arguments but %d given", fn.Id, fn.NumArg, len(args))
+	}
+	if len(vm.frames) >= MaxFrames {
+		return vm.fail(obj.ErrStackOverflow, "stack overflow")
+	}
+	vm.frames = append(vm.frames, &Frame{fn: fn, ins: fn.Instructions, handlers: fn.Handlers, pool: pool, base: len(vm.stack), locals: args, self: self, debug: fn.Debug})
+	return nil
+}
+
+// callSync runs fn to completion and returns its result
+func (vm *VM) callSync(fn *obj.Function, args []obj.Object, self *obj.Instance, pool []obj.Object) (obj.Object, *obj.Error) {
+	depth := len(vm.frames)
+	if err := vm.call(fn, args, self, pool); err != nil {
+		return nil, err
+	}
+	if err := vm.run(depth); err != nil {
+		return nil, err
+	}
+	return vm.pop(), nil
+}
+
+func (vm *VM) ret(v obj.Object) {
+	f := vm.frames[len(vm.frames)-1]
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	vm.stack = vm.stack[:f.base]
+	vm.push(v)
+}
+
+// spread replaces the tuple at pos in args with its elements
+func (vm *VM) spread(args []obj.Object, pos int) ([]obj.Object, *obj.Error) {
+	t, ok := args[pos].(*obj.Tuple)
+	if !ok {
+		return nil, vm.fail(obj.ErrType, "cannot splat %s", args[pos].Inspect())
+	}
+	spread := append([]obj.Object{}, args[:pos]...)
+	spread = append(spread, t.Elems...)
+	return append(spread, args[pos+1:]...), nil
+}
+
+// checked pops the value of a checked store and its limit constant, if the value type has one
+func (vm *VM) checked(f *Frame, vt int) (obj.Object, *obj.Error) {
+	var limit obj.Object
+	if vt == include || vt == exclude || vt == constrained {
+		limit = vm.pop()
+	}
+	v := vm.pop()
+	if err := vm.check(f, v, vt, limit); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parser.ValTypeToIntの値
+const (
+	num         = 0
+	boolType    = 1
+	nilType     = 2
+	include     = 5
+	exclude     = 6
+	constrained = 7
+)
+
+// check raises a constraint error unless v satisfies the value type vt and its limit
+func (vm *VM) check(f *Frame, v obj.Object, vt int, limit obj.Object) *obj.Error {
+	ok := true
+	switch vt {
+	case num:
+		_, ok = toFloat(v)
+	case boolType:
+		_, ok = v.(*obj.Bool)
+	case nilType:
+		_, ok = v.(*obj.Nil)
+	case include, exclude:
+		r := limit.(*obj.Range)
+		i, isInt := v.(*obj.Integer)
+		ok = isInt && (r.From <= i.Value && i.Value <= r.To) == (vt == include)
+	case constrained:
+		var err *obj.Error
+		ok, err = vm.satisfies(f, v, limit.(*obj.Constraint))
+		if err != nil {
+			return err
+		}
+	}
+	if ok {
+		return nil
+	}
+	if limit != nil {
+		return vm.fail(obj.ErrConstraint, "%s violates %s", v.Inspect(), limit.Inspect())
+	}
+	return vm.fail(obj.ErrConstraint, "%s violates type %d", v.Inspect(), vt)
+}
+
+func (vm *VM) satisfies(f *Frame, v obj.Object, c *obj.Constraint) (bool, *obj.Error) {
+	i, ok := v.(*obj.Integer)
+	if !ok {
+		return false, nil
+	}
+	if len(c.Include) > 0 && !inRanges(i.Value, c.Include) {
+		return false, nil
+	}
+	if inRanges(i.Value, c.Exclude) {
+		return false, nil
+	}
+	if len(c.In) > 0 {
+		found := false
+		for _, x := range c.In {
+			found = found || x == i.Value
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	if c.Predicate < 0 {
+		return true, nil
+	}
+	// 述語はselfのクラスのメソッド，なければトップレベルの関数から探す
+	self, pool := f.self, vm.constants
+	if self != nil {
+		pool = self.Class.ConstantPool
+	}
+	pred := findFunction(pool, c.Predicate)
+	if pred == nil {
+		self, pool = nil, vm.constants
+		pred = findFunction(pool, c.Predicate)
+	}
+	if pred == nil {
+		return false, vm.fail(obj.ErrType, "undefined predicate %d", c.Predicate)
+	}
+	result, err := vm.callSync(pred, []obj.Object{v}, self, pool)
+	if err != nil {
+		return false, err
+	}
+	b, ok := result.(*obj.Bool)
+	return ok && b.Value != 0, nil
+}
+
+func inRanges(v int, ranges []obj.Range) bool {
+	for _, r := range ranges {
+		if r.From <= v && v <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func findFunction(pool []obj.Object, id int) *obj.Function {
+	for _, constant := range pool {
+		if fn, ok := constant.(*obj.Function); ok && fn.Id == id {
+			return fn
+		}
+	}
+	return nil
+}
+
+var opSymbols = map[code.Opcode]string{
+	code.OpAdd: "+", code.OpSub: "-", code.OpMul: "*", code.OpDiv: "/", code.OpMod: "%",
+	code.OpAnd: "&", code.OpOr: "|", code.OpXor: "^", code.OpShl: "<<", code.OpShr: ">>",
+}
+
+// arith computes a op b. 整数は32bitで折り返し，小数はbinary32に丸める
+func arith(op code.Opcode, a, b obj.Object) (obj.Object, *obj.Error) {
+	x, okA := a.(*obj.Integer)
+	y, okB := b.(*obj.Integer)
+	if okA && okB {
+		var v int
+		switch op {
+		case code.OpAdd:
+			v = x.Value + y.Value
+		case code.OpSub:
+			v = x.Value - y.Value
+		case code.OpMul:
+			v = x.Value * y.Value
+		case code.OpDiv, code.OpMod:
+			if y.Value == 0 {
+				return nil, &obj.Error{Code: obj.ErrZeroDivision, Msg: "division by zero"}
+			}
+			if op == code.OpDiv {
+				v = x.Value / y.Value
+			} else {
+				v = x.Value % y.Value
+			}
+		case code.OpAnd:
+			v = x.Value & y.Value
+		case code.OpOr:
+			v = x.Value | y.Value
+		case code.OpXor:
+			v = x.Value ^ y.Value
+		case code.OpShl:
+			v = int(int32(x.Value) << uint(y.Value&31))
+		case code.OpShr:
+			v = int(int32(x.Value) >> uint(y.Value&31))
+		}
+		return &obj.Integer{Value: int(int32(v))}, nil
+	}
+	fx, okA := toFloat(a)
+	fy, okB := toFloat(b)
+	if !okA || !okB {
+		bad := a
+		if okA {
+			bad = b
+		}
+		return nil, &obj.Error{Code: obj.ErrType, Msg: fmt.Sprintf("invalid operand %s for %s", bad.Inspect(), opSymbols[op])}
+	}
+	var v float64
+	switch op {
+	case code.OpAdd:
+		v = fx + fy
+	case code.OpSub:
+		v = fx - fy
+	case code.OpMul:
+		v = fx * fy
+	case code.OpDiv:
+		if fy == 0 {
+			return nil, &obj.Error{Code: obj.ErrZeroDivision, Msg: "division by zero"}
+		}
+		v = fx / fy
+	default:
+		return nil, &obj.Error{Code: obj.ErrType, Msg: fmt.Sprintf("invalid operand float for %s", opSymbols[op])}
+	}
+	return &obj.Float{Value: float64(float32(v))}, nil
+}
+
+func toFloat(o obj.Object) (float64, bool) {
+	switch o := o.(type) {
+	case *obj.Integer:
+		return float64(o.Value), true
+	case *obj.Float:
+		return o.Value, true
+	}
+	return math.NaN(), false
+}
+
+func equal(a, b obj.Object) bool {
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	switch a := a.(type) {
+	case *obj.Bool:
+		b, ok := b.(*obj.Bool)
+		return ok && a.Value == b.Value
+	case *obj.Range:
+		b, ok := b.(*obj.Range)
+		return ok && a.From == b.From && a.To == b.To
+	case *obj.Nil:
+		_, ok := b.(*obj.Nil)
+		return ok
+	}
+	return a == b
+}
+
+func boolean(b bool) *obj.Bool {
+	if b {
+		return &obj.Bool{Value: 1}
+	}
+	return &obj.Bool{Value: 0}
+}
+
+func storeLocal(f *Frame, i int, v obj.Object) {
+	for len(f.locals) <= i {
+		f.locals = append(f.locals, nil)
+	}
+	f.locals[i] = v
+}
+
+func (vm *VM) storeGlobal(i int, v obj.Object) {
+	for len(vm.globals) <= i {
+		vm.globals = append(vm.globals, nil)
+	}
+	vm.globals[i] = v
+}
+
+func (vm *VM) push(o obj.Object) {
+	vm.stack = append(vm.stack, o)
+}
+
+func (vm *VM) pop() obj.Object {
+	o := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return o
+}
+
+func (vm *VM) popN(n int) []obj.Object {
+	args := append([]obj.Object{}, vm.stack[len(vm.stack)-n:]...)
+	vm.stack = vm.stack[:len(vm.stack)-n]
+	return args
+}
+
+func (vm *VM) top() obj.Object {
+	return vm.stack[len(vm.stack)-1]
+}
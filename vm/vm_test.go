@@ -0,0 +1,193 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/takeru56/tcompiler/compiler"
+	"github.com/takeru56/tcompiler/parser"
+	"github.com/takeru56/tcompiler/token"
+)
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"7 / 2 + 7 % 3 + 1 << 4", "80"},
+		{"-7 / 2", "-3"},
+		{"2147483647 + 1", "-2147483648"},
+		{"1.5 * 2", "3"},
+		{"1.1 * 1 == 1.1", "true"},
+		{"1.1 + 0", "1.1"},
+		{"1 < 2", "true"},
+		{"a = 0 i = 0 while i < 5 do a = a + i i = i + 1 end a", "10"},
+		{"a = 0 if a == 0 do a = 5 end a", "5"},
+		{"def f(a, b = 10) return a + b end f(1) + f(1, b: 2)", "14"},
+		{"def fib(n) if n < 2 do return n end return fib(n - 1) + fib(n - 2) end fib(15)", "610"},
+		{"def sum(a, *xs) s = a, xs return s end sum(1, 2, 3)", "1, 2, 3"},
+		{"def first(a, *xs) return a end t = 4, 5 first(*t)", "4"},
+		{"a, b = 1, 2 a, b = b, a a - b", "1"},
+		{"def dm(a, b) return a / b, a % b end q, r = dm(7, 2) q * 10 + r", "31"},
+		{"x = 7 case x when 1 then y = 1 when 2..8 then y = 2 else y = 3 end y", "2"},
+		{"x = 4 case x when 1 then y = 1 when 2, 3 then y = 2 when 4..5 then y = 3 else y = 0 end y", "3"},
+		{"x = 9 case x when 1 then y = 1 when 2, 3 then y = 2 when 4..5 then y = 3 else y = 0 end y", "0"},
+		{
+			`
+class Counter
+  def init(n)
+    self.n = n
+  end
+  def add(k)
+    self.n = self.n + k
+    return self.n
+  end
+end
+c = Counter(3)
+c.add(4)
+c.add(1)`,
+			"8",
+		},
+		{"begin a = 1 / 0 rescue e a = 2 end a", "2"},
+		{"a = 0 begin raise 5 rescue e a = 1 ensure a = a + 10 end a", "11"},
+		{"def f() begin raise 1 ensure g = 2 end end a = 0 begin f() rescue a = 3 end a", "3"},
+		{"def f(x) begin return x ensure y = 1 end end f(6)", "6"},
+		{"begin begin raise 1 rescue e raise 2 end rescue e2 r = e2 end 0", "0"},
+		{"a: {include: 1..3} = 2 begin a = 5 rescue a = 1 end a", "1"},
+		{"def even(x) return x % 2 == 0 end a: {check: even} = 2 begin a = 3 rescue a = 0 end a", "0"},
+	}
+
+	for _, c := range cases {
+		vm := New(compile(t, c.input))
+		if err := vm.Run(); err != nil {
+			fmt.Println("input: " + c.input)
+			t.Error(err)
+			continue
+		}
+		if vm.Result() == nil || vm.Result().Inspect() != c.expected {
+			fmt.Println("input: " + c.input)
+			fmt.Println("expected: " + c.expected)
+			fmt.Println("but actual: ", vm.Result())
+			t.Error("wrong result\n")
+		}
+	}
+}
+
+func TestRunErr(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"1 / 0", "Runtime error: division by zero\n\tat main line 1"},
+		{"raise 3", "Runtime error: uncaught 3\n\tat main line 1"},
+		{"a: {include: 1..3} = 5", "Runtime error: 5 violates 1..3\n\tat main line 1"},
+		{"g = 10 def f(): {include: 0..9} return g end f()", "Runtime error: 10 violates 0..9\n\tat f line 1\n\tat main line 1"},
+		{"def f(x) return f(x) end f(1)", "Runtime error: stack overflow\n\tat f line 1 (1023 times)\n\tat main line 1"},
+		{"begin raise 1 ensure a = 2 end", "Runtime error: uncaught 1\n\tat main line 1"},
+		{"def f(x)\n  y = x\n  return y / 0\nend\n\nf(1)", "Runtime error: division by zero\n\tat f line 3\n\tat main line 6"},
+		{"class A\n  def init()\n    raise 2\n  end\nend\na = 1\nb = A()", "Runtime error: uncaught 2\n\tat A.init line 3\n\tat main line 7"},
+		{"def even(x)\n  return x / 0\nend\na: {check: even} = 2", "Runtime error: division by zero\n\tat even line 2\n\tat main line 4"},
+		{"begin\n  raise 1\nrescue e\n  a = 1\nend\nif a == 1 do\n  b = 1 / 0\nend", "Runtime error: division by zero\n\tat main line 7"},
+	}
+
+	for _, c := range cases {
+		err := New(compile(t, c.input)).Run()
+		if err == nil || err.Error() != c.expected {
+			fmt.Println("input: " + c.input)
+			fmt.Println("expected: " + c.expected)
+			fmt.Println("but actual: ", err)
+			t.Error("wrong runtime error\n")
+		}
+	}
+}
+
+func TestRunMerged(t *testing.T) {
+	cases := []struct {
+		first    string
+		second   string
+		expected string
+	}{
+		{"a = 1", "b = 2 b + 1", "3"},
+		{"def f(x) return x + 1 end n = f(1)", "def g(x) return x * 2 end g(3)", "6"},
+		{"x = 1 if x == 1 do x = 2 end", "y = 3 while y > 0 do y = y - 1 end y", "0"},
+		{"class A def init(v) self.v = v end def get() return self.v end end a = A(1)", "class B def init() self.w = 4 end def get() return self.w end end b = B() b.get()", "4"},
+		{"a = 0", "x = 2 case x when 1 then y = 1 when 2 then y = 2 when 3 then y = 3 end y", "2"},
+		{"a = 0", "begin raise 1 rescue e r = 5 end r", "5"},
+	}
+
+	for _, c := range cases {
+		first := compile(t, c.first)
+		merged, err := first.Merge(compile(t, c.second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm := New(merged)
+		if err := vm.Run(); err != nil {
+			fmt.Println("input: " + c.first + " / " + c.second)
+			t.Error(err)
+			continue
+		}
+		if vm.Result() == nil || vm.Result().Inspect() != c.expected {
+			fmt.Println("input: " + c.first + " / " + c.second)
+			fmt.Println("expected: " + c.expected)
+			fmt.Println("but actual: ", vm.Result())
+			t.Error("wrong result\n")
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"a = 1 def f(x) return x + a end", ""},
+		{"a = a + 1 f(1)", "3"},
+		{"b = 1 / 0", "Runtime error: division by zero\n\tat main line 1"},
+		{"class A def init(v) self.v = v end def get() return self.v + a end end", ""},
+		{"A(5).get()", "7"},
+		{"a", "2"},
+	}
+
+	c := compiler.New()
+	var vm *VM
+	for _, tc := range cases {
+		b, err := c.Compile(parse(t, tc.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vm == nil {
+			vm = New(b)
+		}
+		actual := ""
+		if err := vm.Resume(b); err != nil {
+			actual = err.Error()
+		} else if vm.Result() != nil {
+			actual = vm.Result().Inspect()
+		}
+		if actual != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.input, tc.expected, actual)
+		}
+	}
+}
+
+func parse(t *testing.T, input string) []parser.Node {
+	p, err := parser.New(token.New(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := p.Program()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	b, err := compiler.Exec(parse(t, input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}